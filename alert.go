@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// alert types
+const (
+	alertSensor    = "sensor"
+	alertBand      = "band"
+	alertWatering  = "watering"
+	alertRotation  = "rotation"
+	alertCamera    = "camera"
+	alertPush      = "push"
+	alertDisk      = "disk"
+	alertReservoir = "reservoir"
+)
+
+// alarmConfig configures the alert manager and its notifiers. Alerts are
+// shown in the web UI and published over MQTT in any case.
+type alarmConfig struct {
+	// Webhook is the URL alerts are posted to as JSON.
+	Webhook string
+	SMTP    smtpConfig
+	// Cooldown is the minimum time in minutes between notifications of
+	// alerts of the same type and state, repeated alerts are counted.
+	Cooldown int
+	// BandHours is the number of hours weight has to be out of band to
+	// raise an alert, 0 disables the alert.
+	BandHours int
+	// MinFreeDisk is the free disk space in MB below an alert is raised.
+	MinFreeDisk int
+}
+
+type smtpConfig struct {
+	// Server is host and port of the SMTP server, empty disables mail.
+	Server string
+	User   string
+	Pass   string
+	From   string
+	To     []string
+}
+
+// An alert is a notification about a failure or an abnormal state.
+type alert struct {
+	Type string `json:"type"`
+	// State is the state of the alerted condition, e.g. "dead" or "ok"
+	// of the sensor, empty for alerts without states.
+	State   string `json:"state,omitempty"`
+	Message string `json:"message"`
+	// Time is the unix time of the alert.
+	Time int64 `json:"time"`
+	// Repeated is the number of alerts of same type and state suppressed
+	// during cooldown before this one.
+	Repeated int `json:"repeated,omitempty"`
+}
+
+// A notifier delivers alerts.
+type notifier interface {
+	notify(a alert) error
+}
+
+type webhookNotifier struct {
+	url   string
+	topic string
+}
+
+func (n webhookNotifier) notify(a alert) error {
+	b, err := json.Marshal(struct {
+		alert
+		Topic string `json:"topic"`
+	}{a, n.topic})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	config smtpConfig
+	name   string
+}
+
+func (n smtpNotifier) notify(a alert) error {
+	c := n.config
+
+	var auth smtp.Auth
+	if c.User != "" {
+		host := c.Server
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", c.User, c.Pass, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [%s] %s alert\r\n", n.name, a.Type)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Unix(a.Time, 0).Format(time.RFC1123Z))
+	fmt.Fprint(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", a.Message)
+	if a.Repeated > 0 {
+		fmt.Fprintf(&msg, "\r\nRepeated %d times since last notification.\r\n", a.Repeated)
+	}
+
+	return smtp.SendMail(c.Server, auth, c.From, c.To, msg.Bytes())
+}
+
+type mqttNotifier struct {
+	s *station
+}
+
+func (n mqttNotifier) notify(a alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return n.s.publishPersistent(n.s.MQTT.Topic+"/alert", byte(1), string(b))
+}
+
+// maxAlerts is the number of recent alerts kept for the web UI.
+const maxAlerts = 20
+
+// An alertManager deduplicates alerts and delivers them to notifiers in
+// background. Alerts of the same type and state are notified once per
+// cooldown.
+type alertManager struct {
+	clock     clock
+	cooldown  time.Duration
+	notifiers []notifier
+
+	mutex sync.Mutex
+	// last notification and suppressed alerts by type and state
+	last       map[string]time.Time
+	suppressed map[string]int
+	recent     []alert
+
+	queue chan alert
+}
+
+func newAlertManager(clk clock, cooldown time.Duration, notifiers []notifier) *alertManager {
+	m := &alertManager{
+		clock:      clk,
+		cooldown:   cooldown,
+		notifiers:  notifiers,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		queue:      make(chan alert, 16),
+	}
+	go m.run()
+	return m
+}
+
+// newAlertManager creates the alert manager with the notifiers configured
+// in server config.
+func (s *station) newAlertManager() *alertManager {
+	c := s.serverConfig.Alarm
+	notifiers := []notifier{mqttNotifier{s}}
+	if c.Webhook != "" {
+		notifiers = append(notifiers, webhookNotifier{c.Webhook, s.MQTT.Topic})
+	}
+	if c.SMTP.Server != "" {
+		name := s.MQTT.Topic
+		if name == "" {
+			name = "plantcare"
+		}
+		notifiers = append(notifiers, smtpNotifier{c.SMTP, name})
+	}
+	return newAlertManager(s.clock, time.Duration(c.Cooldown)*time.Minute, notifiers)
+}
+
+// raise raises an alert of given type, a nil manager only logs it.
+func (m *alertManager) raise(typ, format string, v ...interface{}) {
+	m.raiseState(typ, "", format, v...)
+}
+
+// raiseState raises an alert of given type about a condition in given
+// state. The cooldown applies per state, so a change of state, e.g. the
+// recovery from a failure, is notified within the cooldown of the failure.
+func (m *alertManager) raiseState(typ, state, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	log.Printf("%s alert: %s", typ, msg)
+	if m == nil {
+		return
+	}
+
+	now := m.clock.Now()
+	a := alert{Type: typ, State: state, Message: msg, Time: now.Unix()}
+	key := typ + "/" + state
+
+	m.mutex.Lock()
+	if last, ok := m.last[key]; ok && now.Sub(last) < m.cooldown {
+		m.suppressed[key]++
+		m.mutex.Unlock()
+		return
+	}
+	a.Repeated = m.suppressed[key]
+	delete(m.suppressed, key)
+	m.last[key] = now
+	m.recent = append(m.recent, a)
+	if len(m.recent) > maxAlerts {
+		m.recent = m.recent[len(m.recent)-maxAlerts:]
+	}
+	m.mutex.Unlock()
+
+	select {
+	case m.queue <- a:
+	default:
+		log.Printf("alert queue full, dropping %s alert", typ)
+	}
+}
+
+// alerts returns the recent alerts.
+func (m *alertManager) alerts() []alert {
+	if m == nil {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	a := make([]alert, len(m.recent))
+	copy(a, m.recent)
+	return a
+}
+
+func (m *alertManager) run() {
+	for a := range m.queue {
+		for _, n := range m.notifiers {
+			if err := n.notify(a); err != nil {
+				log.Printf("failed to notify %s alert: %v", a.Type, err)
+			}
+		}
+	}
+}
+
+// checkDisk raises an alert if free space of the file systems of data and
+// pictures falls below MinFreeDisk.
+func (s *station) checkDisk() {
+	min := uint64(s.serverConfig.Alarm.MinFreeDisk) << 20
+	if min == 0 {
+		return
+	}
+
+	for _, dir := range []string{s.serverConfig.Files.Pictures, s.serverConfig.Files.History} {
+		if dir == "" {
+			continue
+		}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			log.Printf("failed to get free space of %s: %v", dir, err)
+			continue
+		}
+		if free := st.Bavail * uint64(st.Bsize); free < min {
+			s.alerts.raise(alertDisk, "%d MB free on %s", free>>20, dir)
+		}
+	}
+}
+
+// checkBand raises an alert if weight stayed out of band for BandHours,
+// must be called with locked mutex.
+func (s *station) checkBand() {
+	hours := s.serverConfig.Alarm.BandHours
+	n := len(s.Data.Weight)
+	if hours <= 0 || n < hours {
+		return
+	}
+
+	below, above := 0, 0
+	for _, w := range s.Data.Weight[n-hours:] {
+		if w < s.Config.LowLevel {
+			below++
+		} else if w > s.Config.HighLevel {
+			above++
+		}
+	}
+	if below == hours {
+		s.alerts.raiseState(alertBand, "below", "weight %v below low level %v for %v hours",
+			s.Data.Weight[n-1], s.Config.LowLevel, hours)
+	} else if above == hours {
+		s.alerts.raiseState(alertBand, "above", "weight %v above high level %v for %v hours",
+			s.Data.Weight[n-1], s.Config.HighLevel, hours)
+	}
+}
+
+func alertsHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		js, err := json.Marshal(s.alerts.alerts())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
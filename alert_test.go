@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifierFunc delivers alerts to a function.
+type notifierFunc func(a alert) error
+
+func (f notifierFunc) notify(a alert) error {
+	return f(a)
+}
+
+func TestAlertCooldown(t *testing.T) {
+	clk := newFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	notified := make(chan alert, 16)
+	m := newAlertManager(clk, time.Hour, []notifier{notifierFunc(func(a alert) error {
+		notified <- a
+		return nil
+	})})
+
+	m.raiseState(alertReservoir, reservoirEmpty, "empty")
+	clk.Sleep(time.Minute)
+	m.raiseState(alertReservoir, reservoirEmpty, "empty")
+	// refill is notified within cooldown of empty reservoir
+	m.raiseState(alertReservoir, "ok", "refilled")
+	clk.Sleep(time.Minute)
+	m.raiseState(alertReservoir, reservoirEmpty, "empty")
+	m.raise(alertDisk, "full")
+	clk.Sleep(time.Hour)
+	m.raiseState(alertReservoir, reservoirEmpty, "empty")
+
+	want := []alert{
+		{Type: alertReservoir, State: reservoirEmpty, Message: "empty"},
+		{Type: alertReservoir, State: "ok", Message: "refilled"},
+		{Type: alertDisk, Message: "full"},
+		{Type: alertReservoir, State: reservoirEmpty, Message: "empty", Repeated: 2},
+	}
+	for i, w := range want {
+		select {
+		case a := <-notified:
+			a.Time = 0
+			if a != w {
+				t.Errorf("notification %d: got %+v, want %+v", i, a, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("notification %d: timed out", i)
+		}
+	}
+
+	if n := len(m.alerts()); n != len(want) {
+		t.Errorf("got %d recent alerts, want %d", n, len(want))
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got struct {
+		alert
+		Topic string `json:"topic"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type %s, want application/json", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		if got.Type == alertDisk {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	n := webhookNotifier{srv.URL, "plant"}
+	a := alert{Type: alertReservoir, State: reservoirLow, Message: "low", Time: 42, Repeated: 1}
+	if err := n.notify(a); err != nil {
+		t.Fatal(err)
+	}
+	if got.alert != a || got.Topic != "plant" {
+		t.Errorf("posted %+v, want %+v with topic plant", got, a)
+	}
+
+	if err := n.notify(alert{Type: alertDisk}); err == nil {
+		t.Error("no error on failed post")
+	}
+}
+
+// smtpStandIn accepts a single mail on a local port and sends its data to
+// the returned channel.
+func smtpStandIn(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	mail := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 end data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				mail <- data.String()
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String(), mail
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, mail := smtpStandIn(t)
+
+	n := smtpNotifier{smtpConfig{
+		Server: addr,
+		From:   "station@example.com",
+		To:     []string{"a@example.com", "b@example.com"},
+	}, "plant"}
+	a := alert{Type: alertReservoir, State: reservoirLow, Message: "reservoir low", Time: 42, Repeated: 3}
+	if err := n.notify(a); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg string
+	select {
+	case msg = <-mail:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+	for _, s := range []string{
+		"From: station@example.com\r\n",
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: [plant] reservoir alert\r\n",
+		"\r\nreservoir low\r\n",
+		"Repeated 3 times",
+	} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("mail %q does not contain %q", msg, s)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// backtestSample is a recorded hourly sample replayed by backtest.
+type backtestSample struct {
+	time     time.Time
+	weight   int
+	watering int
+}
+
+// readBacktestData reads hourly samples from a data.json, a /data dump or
+// a /history export.
+func readBacktestData(file string) ([]backtestSample, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		var hs []historySample
+		if err := json.Unmarshal(b, &hs); err != nil {
+			return nil, err
+		}
+		samples := make([]backtestSample, len(hs))
+		for i, h := range hs {
+			samples[i] = backtestSample{time.Unix(h.Time, 0), h.Weight, h.Watering}
+		}
+		return samples, nil
+	}
+
+	var dump struct {
+		Data *measurementData `json:"data"`
+	}
+	if err := json.Unmarshal(b, &dump); err != nil {
+		return nil, err
+	}
+
+	d := dump.Data
+	if d == nil {
+		d = &measurementData{}
+		if err := json.Unmarshal(b, d); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(d.Watering) != len(d.Weight) {
+		return nil, fmt.Errorf("%d waterings for %d weights", len(d.Watering), len(d.Weight))
+	}
+
+	if len(d.Times) != len(d.Weight) {
+		// no timestamps stored, assume last sample today at Time
+		last := time.Now().Truncate(time.Hour)
+		for i := 0; i < 24 && last.Hour() != d.Time; i++ {
+			last = last.Add(-time.Hour)
+		}
+		d.migrate(last, time.Hour)
+	}
+
+	samples := make([]backtestSample, len(d.Weight))
+	for i := range d.Weight {
+		samples[i] = backtestSample{time.Unix(d.Times[i], 0), d.Weight[i], d.Watering[i]}
+	}
+	return samples, nil
+}
+
+// runBacktest replays recorded hourly data through the watering calculation
+// with a candidate plant config and reports the resulting waterings.
+func runBacktest(args []string) {
+	fs := flag.NewFlagSet("backtest", flag.ExitOnError)
+	configFile := fs.String("config", "", "candidate plant config")
+	waterTimeFile := fs.String("watertime", "", "initial watering time data")
+	verbose := fs.Bool("v", false, "log watering calculation")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: plantcare backtest [flags] data.json")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	samples, err := readBacktestData(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", fs.Arg(0), err)
+	}
+
+	s := station{
+		Config: defaultPlantConfig,
+	}
+
+	if *configFile != "" {
+		if err := readJSONFile(*configFile, &s.Config); err != nil {
+			log.Fatalf("failed to read %s: %v", *configFile, err)
+		}
+	}
+	if *waterTimeFile != "" {
+		if err := readJSONFile(*waterTimeFile, &s.WateringTimeData); err != nil {
+			log.Fatalf("failed to read %s: %v", *waterTimeFile, err)
+		}
+	}
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	r := s.backtest(samples)
+
+	fmt.Println("time                  weight  actual  predicted")
+	for _, w := range r.waterings {
+		fmt.Printf("%s  %6d  %6d  %9d\n",
+			w.time.Format("2006-01-02 15:04 MST"), w.weight, w.watering, w.predicted)
+	}
+	fmt.Println()
+	fmt.Printf("hours:              %d\n", len(samples))
+	fmt.Printf("below low level:    %d (actual %d)\n", r.below, r.actualBelow)
+	fmt.Printf("above high level:   %d (actual %d)\n", r.above, r.actualAbove)
+	fmt.Printf("waterings:          %d (actual %d)\n", r.count, r.actualCount)
+	fmt.Printf("total watering:     %d ms (actual %d ms)\n", r.total, r.actualTotal)
+	fmt.Printf("final model:        scale %d, offset %d\n",
+		s.WateringTimeData.Scale, s.WateringTimeData.Offset)
+}
+
+type backtestWatering struct {
+	backtestSample
+	predicted int
+}
+
+type backtestResult struct {
+	// hours with predicted weight outside band
+	below, above int
+	// hours with recorded weight outside band
+	actualBelow, actualAbove int
+	count, actualCount       int
+	total, actualTotal       int
+	waterings                []backtestWatering
+}
+
+// backtest replays samples hour by hour on a fake clock set to the time of
+// each sample. The weight seen by the watering calculation is the recorded
+// weight corrected by the weight difference of predicted and recorded
+// waterings, estimated with the current model.
+func (s *station) backtest(samples []backtestSample) backtestResult {
+	var r backtestResult
+	const maxHours = backlogDays * 24
+
+	clk, ok := s.clock.(*fakeClock)
+	if !ok && len(samples) > 0 {
+		clk = newFakeClock(samples[0].time)
+		s.clock = clk
+	}
+
+	// weight difference to recorded weight caused by predicted waterings
+	correction := 0
+
+	for _, smp := range samples {
+		clk.Sleep(smp.time.Sub(clk.Now()))
+		w := smp.weight + correction
+		hour := smp.time.Hour()
+
+		wt := 0
+		if s.wateringDue(hour, w) {
+			wt = s.calculateWatering(hour, w, true)
+			if wt < 0 {
+				wt = 0
+			}
+		}
+
+		if wt > 0 || smp.watering > 0 {
+			r.waterings = append(r.waterings, backtestWatering{smp, wt})
+		}
+
+		if scale := s.WateringTimeData.Scale; scale > 0 {
+			correction += (wt - smp.watering) / scale
+		}
+
+		if w < s.Config.LowLevel {
+			r.below++
+		} else if w > s.Config.HighLevel {
+			r.above++
+		}
+		if smp.weight < s.Config.LowLevel {
+			r.actualBelow++
+		} else if smp.weight > s.Config.HighLevel {
+			r.actualAbove++
+		}
+		if wt > 0 {
+			r.count++
+			r.total += wt
+		}
+		if smp.watering > 0 {
+			r.actualCount++
+			r.actualTotal += smp.watering
+		}
+
+		s.Data.Time = hour
+		s.Data.push(smp.time, w, qualityMeasured, maxHours)
+		s.Data.Watering = pushSlice(s.Data.Watering, wt, maxHours)
+	}
+
+	return r
+}
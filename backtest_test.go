@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestBacktest(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var samples []backtestSample
+	w := 1450
+	for h := 0; h < 5*24; h++ {
+		smp := backtestSample{time: start.Add(time.Duration(h) * time.Hour), weight: w}
+		if h%24 == 20 && w < 1400 {
+			smp.watering = 10000
+		}
+		samples = append(samples, smp)
+		w -= 3
+		if smp.watering > 0 {
+			w += 100
+		}
+	}
+
+	s := station{Config: defaultPlantConfig}
+	s.WateringTimeData.Scale = 100
+	r := s.backtest(samples)
+
+	if r.actualCount == 0 {
+		t.Fatal("no recorded waterings replayed")
+	}
+	if r.count == 0 {
+		t.Error("no waterings predicted")
+	}
+	if got := s.clock.Now(); !got.Equal(samples[len(samples)-1].time) {
+		t.Errorf("clock at %v, want time of last sample", got)
+	}
+}
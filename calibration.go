@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A calibration converts raw load cell counts to grams. The zero value
+// passes counts through unchanged.
+type calibration struct {
+	// Offset is the count with no load.
+	Offset float64 `json:"offset"`
+	// Scale is grams per count, 0 if not calibrated.
+	Scale float64 `json:"scale"`
+	// TempCoeff is the drift in counts per °C from RefTemp.
+	TempCoeff float64 `json:"tempcoeff"`
+	RefTemp   float64 `json:"reftemp"`
+	// Points are the points the calibration was fitted to.
+	Points []calibrationPoint `json:"points,omitempty"`
+	// Time is the unix time of calibration.
+	Time int64 `json:"time,omitempty"`
+}
+
+// calibrationPoint is a raw reading of a known weight.
+type calibrationPoint struct {
+	Raw   float64 `json:"raw"`
+	Grams float64 `json:"grams"`
+	// Temp is the temperature at reading, omitted if unknown.
+	Temp *float64 `json:"temp,omitempty"`
+}
+
+// calibrationSamples is the number of readings a calibration point is the
+// median of.
+const calibrationSamples = 5
+
+func (c *calibration) calibrated() bool {
+	return c.Scale != 0
+}
+
+func (c *calibration) scale() float64 {
+	if c.Scale == 0 {
+		return 1
+	}
+	return c.Scale
+}
+
+// compensate returns raw count compensated for temperature, temp is NaN if
+// unknown.
+func (c *calibration) compensate(raw, temp float64) float64 {
+	if c.TempCoeff != 0 && !math.IsNaN(temp) {
+		raw -= c.TempCoeff * (temp - c.RefTemp)
+	}
+	return raw
+}
+
+// grams converts a raw count at given temperature to grams.
+func (c *calibration) grams(raw int, temp float64) int {
+	return int(math.Floor(c.fromRaw(c.compensate(float64(raw), temp)) + 0.5))
+}
+
+func (c *calibration) fromRaw(raw float64) float64 {
+	return (raw - c.Offset) * c.scale()
+}
+
+// toRaw converts grams back to a compensated raw count.
+func (c *calibration) toRaw(grams float64) float64 {
+	return grams/c.scale() + c.Offset
+}
+
+// fitCalibration fits offset and scale to given points by least squares.
+func fitCalibration(points []calibrationPoint, tempCoeff, refTemp float64) (calibration, error) {
+	c := calibration{
+		TempCoeff: tempCoeff,
+		RefTemp:   refTemp,
+		Points:    points,
+	}
+
+	n := float64(len(points))
+	var sx, sy, sxx, sxy float64
+	for _, p := range points {
+		x := p.Raw
+		if p.Temp != nil {
+			x = c.compensate(x, *p.Temp)
+		}
+		sx += x
+		sy += p.Grams
+		sxx += x * x
+		sxy += x * p.Grams
+	}
+
+	d := n*sxx - sx*sx
+	if len(points) < 2 || math.Abs(d) < 1e-9 {
+		return c, fmt.Errorf("need at least two points of different weight")
+	}
+
+	// grams = scale*raw + b
+	c.Scale = (n*sxy - sx*sy) / d
+	b := (sy - c.Scale*sx) / n
+	if c.Scale == 0 {
+		return c, fmt.Errorf("weight does not change with load")
+	}
+	c.Offset = -b / c.Scale
+
+	return c, nil
+}
+
+// readTemperature returns the temperature in °C read from the configured
+// sysfs file in millidegrees, NaN if not available.
+func (s *station) readTemperature() float64 {
+	file := s.serverConfig.Files.Temperature
+	if file == "" {
+		return math.NaN()
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("failed to read temperature: %v", err)
+		return math.NaN()
+	}
+	mc, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		log.Printf("invalid temperature %q: %v", b, err)
+		return math.NaN()
+	}
+	return float64(mc) / 1000
+}
+
+// readWeight reads the load cell and returns weight in grams and raw
+// count.
+func (s *station) readWeight() (grams, raw int, err error) {
+	raw, err = s.wuc.ReadWeight()
+	if err != nil {
+		return 0, 0, err
+	}
+	temp := s.readTemperature()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.Calibration.grams(raw, temp), raw, nil
+}
+
+func (s *station) readCalibration() {
+	file := s.serverConfig.Files.Calibration
+	if file == "" {
+		return
+	}
+	err := readJSONFile(file, &s.Calibration)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to read calibration from %s: %v", file, err)
+	}
+}
+
+// applyCalibration replaces the calibration and converts weights, levels,
+// sensor thresholds, watering models and history to the units of the new
+// calibration.
+func (s *station) applyCalibration(c calibration) error {
+	s.mutex.Lock()
+	old := s.Calibration
+	c.Time = s.clock.Now().Unix()
+	if c.Time <= old.Time {
+		// tags history samples, must differ from old calibration
+		c.Time = old.Time + 1
+	}
+
+	conv := func(g int) int {
+		return int(math.Floor(c.fromRaw(old.toRaw(float64(g))) + 0.5))
+	}
+	// factor of weight differences, levels swap if the sign changes
+	k := math.Abs(c.scale() / old.scale())
+	convDelta := func(d int) int {
+		return int(math.Floor(float64(d)*k + 0.5))
+	}
+
+	for _, d := range []*measurementData{&s.Data, &s.MinData} {
+		for i, w := range d.Weight {
+			d.Weight[i] = conv(w)
+		}
+	}
+
+	for i, w := range s.Sensor.Outliers {
+		s.Sensor.Outliers[i] = conv(w)
+	}
+	spike := s.serverConfig.Sensor.Spike
+	if spike > 0 {
+		s.serverConfig.Sensor.Spike = convDelta(spike)
+	}
+
+	cfg := s.Config
+	cfg.LowLevel = conv(cfg.LowLevel)
+	cfg.HighLevel = conv(cfg.HighLevel)
+	if cfg.LowLevel > cfg.HighLevel {
+		cfg.LowLevel, cfg.HighLevel = cfg.HighLevel, cfg.LowLevel
+	}
+	cfg.DailyRefill = convDelta(cfg.DailyRefill)
+	cfg.LevelRange = convDelta(cfg.LevelRange)
+	cfg.Windows = append([]wateringWindow(nil), cfg.Windows...)
+	for i := range cfg.Windows {
+		cfg.Windows[i].Refill = convDelta(cfg.Windows[i].Refill)
+	}
+	if k != 0 {
+		s.WateringTimeData.Scale = int(math.Floor(float64(s.WateringTimeData.Scale)/k + 0.5))
+		if cfg.Model != nil {
+			m := *cfg.Model
+			m.Scale = int(math.Floor(float64(m.Scale)/k + 0.5))
+			cfg.Model = &m
+		}
+		for i := range s.models {
+			s.models[i].convert(k)
+		}
+	}
+	s.Config = cfg
+
+	s.Calibration = c
+	s.mutex.Unlock()
+
+	log.Printf("applied calibration: offset %v, scale %v, temp coeff %v",
+		c.Offset, c.Scale, c.TempCoeff)
+
+	if s.history != nil {
+		// untagged samples written since the old calibration are in its
+		// units, older ones in unknown units are kept
+		err := s.history.Convert(func(smp historySample) historySample {
+			if smp.Cal == 0 && smp.Time >= old.Time || smp.Cal != 0 && smp.Cal == old.Time {
+				smp.Weight = conv(smp.Weight)
+				smp.Cal = c.Time
+			}
+			return smp
+		})
+		if err != nil {
+			log.Printf("failed to convert history: %v", err)
+		}
+	}
+
+	if spike > 0 {
+		if err := s.saveServerConfig(); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if s.serverConfig.Files.Config != "" {
+		if err := writeFileAtomic(s.serverConfig.Files.Config, b, 0600); err != nil {
+			return err
+		}
+	}
+
+	s.checkpoint()
+
+	if s.serverConfig.Files.Calibration == "" {
+		return nil
+	}
+	b, err = json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.serverConfig.Files.Calibration, b, 0600)
+}
+
+// calibrationSession collects points of a guided calibration.
+type calibrationSession struct {
+	Points []calibrationPoint `json:"points"`
+}
+
+// measureCalibrationPoint reads the median of calibrationSamples raw
+// counts for a known weight.
+func (s *station) measureCalibrationPoint(grams float64) (calibrationPoint, error) {
+	raws := make([]int, 0, calibrationSamples)
+	for i := 0; i < calibrationSamples; i++ {
+		r, err := s.wuc.ReadWeight()
+		if err != nil {
+			log.Printf("failed to read weight: %v", err)
+			continue
+		}
+		raws = append(raws, r)
+	}
+	if len(raws) == 0 {
+		return calibrationPoint{}, fmt.Errorf("failed to read weight")
+	}
+	sort.Ints(raws)
+
+	p := calibrationPoint{Raw: float64(raws[len(raws)/2]), Grams: grams}
+	if t := s.readTemperature(); !math.IsNaN(t) {
+		p.Temp = &t
+	}
+	return p, nil
+}
+
+// calibrationHandler guides through calibration. GET returns calibration
+// and current session, POST with step "tare" starts a session with the
+// empty pot, "point" adds a known weight in grams, "finish" fits and
+// applies the calibration and "cancel" ends the session.
+func calibrationHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := s.calibrationStep(r); err != nil {
+				log.Printf("calibration failed: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		s.mutex.RLock()
+		js, err := json.Marshal(struct {
+			Calibration calibration         `json:"calibration"`
+			Session     *calibrationSession `json:"session"`
+		}{s.Calibration, s.calibrationSession})
+		s.mutex.RUnlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
+
+func (s *station) calibrationStep(r *http.Request) error {
+	q := r.URL.Query()
+	parse := func(name string) (float64, bool, error) {
+		v := q.Get(name)
+		if v == "" {
+			return 0, false, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		return f, true, nil
+	}
+
+	switch step := q.Get("step"); step {
+	case "tare":
+		p, err := s.measureCalibrationPoint(0)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.calibrationSession = &calibrationSession{Points: []calibrationPoint{p}}
+		s.mutex.Unlock()
+		log.Printf("calibration tare: %v", p.Raw)
+
+	case "point":
+		grams, ok, err := parse("grams")
+		if err != nil {
+			return err
+		} else if !ok || grams <= 0 {
+			return fmt.Errorf("missing weight in grams")
+		}
+		s.mutex.RLock()
+		started := s.calibrationSession != nil
+		s.mutex.RUnlock()
+		if !started {
+			return fmt.Errorf("no calibration started, tare first")
+		}
+		p, err := s.measureCalibrationPoint(grams)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		if s.calibrationSession != nil {
+			s.calibrationSession.Points = append(s.calibrationSession.Points, p)
+		}
+		s.mutex.Unlock()
+		log.Printf("calibration point: %v g at %v", grams, p.Raw)
+
+	case "finish":
+		s.mutex.RLock()
+		cs := s.calibrationSession
+		old := s.Calibration
+		s.mutex.RUnlock()
+		if cs == nil {
+			return fmt.Errorf("no calibration started, tare first")
+		}
+
+		tc, ok, err := parse("tempcoeff")
+		if err != nil {
+			return err
+		} else if !ok {
+			tc = old.TempCoeff
+		}
+		ref := old.RefTemp
+		if t := cs.Points[0].Temp; t != nil {
+			ref = *t
+		}
+
+		c, err := fitCalibration(cs.Points, tc, ref)
+		if err != nil {
+			return err
+		}
+		if err := s.applyCalibration(c); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.calibrationSession = nil
+		s.mutex.Unlock()
+
+	case "cancel":
+		s.mutex.Lock()
+		s.calibrationSession = nil
+		s.mutex.Unlock()
+
+	default:
+		return fmt.Errorf("invalid calibration step: %q", step)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestApplyCalibration(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := newFakeClock(start)
+
+	h, err := NewHistory(filesConfig{History: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &station{clock: clk, Config: defaultPlantConfig, history: h}
+	s.serverConfig.Sensor.Spike = 20
+	s.serverConfigFile = filepath.Join(t.TempDir(), "server.conf")
+	s.Data.push(start, 1400, qualityMeasured, 10)
+	s.Data.Watering = []int{0}
+	s.WateringTimeData.Scale = 100
+	s.models = []modelFit{{
+		Dryout:        60,
+		Scale:         100,
+		Offset:        500,
+		SumGain:       30,
+		SumGain2:      500,
+		SumTime:       4000,
+		SumGainTime:   70000,
+		DryoutSamples: []int{2, 3},
+		Points:        []modelPoint{{Time: 1, Watering: 3000, Gain: 25}},
+	}}
+	if err := h.AddHour(historySample{Time: start.Unix(), Weight: 1400}); err != nil {
+		t.Fatal(err)
+	}
+
+	// two grams per count
+	clk.Sleep(time.Hour)
+	if err := s.applyCalibration(calibration{Scale: 2}); err != nil {
+		t.Fatal(err)
+	}
+	cal := s.Calibration.Time
+
+	if s.Data.Weight[0] != 2800 {
+		t.Errorf("weight %v, want 2800", s.Data.Weight[0])
+	}
+	if s.Config.LowLevel != 2800 || s.Config.HighLevel != 3000 {
+		t.Errorf("levels %v-%v, want 2800-3000", s.Config.LowLevel, s.Config.HighLevel)
+	}
+	if s.WateringTimeData.Scale != 50 {
+		t.Errorf("watering scale %v, want 50", s.WateringTimeData.Scale)
+	}
+	want := modelFit{
+		Dryout:        120,
+		Scale:         50,
+		Offset:        500,
+		SumGain:       60,
+		SumGain2:      2000,
+		SumTime:       4000,
+		SumGainTime:   140000,
+		DryoutSamples: []int{4, 6},
+		Points:        []modelPoint{{Time: 1, Watering: 3000, Gain: 50}},
+	}
+	if !reflect.DeepEqual(s.models[0], want) {
+		t.Errorf("model %+v, want %+v", s.models[0], want)
+	}
+	if s.serverConfig.Sensor.Spike != 40 {
+		t.Errorf("spike threshold %v, want 40", s.serverConfig.Sensor.Spike)
+	}
+	// converted threshold is kept over a restart
+	b, err := os.ReadFile(s.serverConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved serverConfig
+	if err := toml.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Sensor.Spike != 40 {
+		t.Errorf("saved spike threshold %v, want 40", saved.Sensor.Spike)
+	}
+
+	// sample in new calibration is not converted again
+	clk.Sleep(time.Hour)
+	if err := h.AddMinute(clk.Now(), 3000, 1500, qualityMeasured, cal); err != nil {
+		t.Fatal(err)
+	}
+	samples, err := h.Read(historyHour, start, clk.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Weight != 2800 || samples[0].Cal != cal {
+		t.Errorf("history %+v, want weight 2800 in calibration %v", samples, cal)
+	}
+
+	// back to counts
+	if err := s.applyCalibration(calibration{Scale: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range []string{historyHour, historyMinute} {
+		samples, err := h.Read(res, start, clk.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, smp := range samples {
+			if smp.Weight != 1400 && smp.Weight != 1500 || smp.Cal != s.Calibration.Time {
+				t.Errorf("%s history sample %+v not converted", res, smp)
+			}
+		}
+	}
+}
+
+func TestCalibrationSuppressesWatering(t *testing.T) {
+	setLocal(t, time.UTC)
+
+	c := defaultPlantConfig
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, sim, _ := newTestStation(c, start)
+	// pot dry, watering due at WaterHour
+	sim.weight = float64(c.LowLevel - 100)
+	s.calibrationSession = &calibrationSession{}
+
+	s.runUntil(start.AddDate(0, 0, 1))
+
+	suppressed := 0
+	for i := range s.Data.Watering {
+		if s.Data.Watering[i] > 0 {
+			t.Errorf("watered %v ms during calibration at %v", s.Data.Watering[i],
+				time.Unix(s.Data.Times[i], 0))
+		}
+		if s.Data.Quality[i] != qualityCalibrating {
+			t.Errorf("hourly sample at %v not flagged", time.Unix(s.Data.Times[i], 0))
+		}
+		suppressed += s.Data.Suppressed[i]
+	}
+	if suppressed == 0 {
+		t.Error("no suppressed watering recorded")
+	}
+	for i, q := range s.MinData.Quality {
+		if q != qualityCalibrating {
+			t.Errorf("minute sample at %v not flagged", time.Unix(s.MinData.Times[i], 0))
+			break
+		}
+	}
+}
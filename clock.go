@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A clock provides the current time and sleeping. The station and the
+// simulator run on a fakeClock for executing in virtual time.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// A fakeClock is a virtual clock which is only advanced by Sleep, so
+// sleeping returns immediately.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock(t time.Time) *fakeClock {
+	return &fakeClock{now: t}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
+// truncateHour returns t rounded down to the full hour in the location of
+// t. Unlike t.Truncate(time.Hour) it works in time zones with offsets of
+// fractional hours.
+func truncateHour(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	return t.Add(-time.Duration(t.Minute()) * time.Minute)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"gobot.io/x/gobot/drivers/i2c"
+	"gobot.io/x/gobot/platforms/raspi"
+)
+
+// A Controller provides access to the watering hardware of a plant station.
+type Controller interface {
+	// ReadWeight returns the current raw value of the weight sensor.
+	ReadWeight() (int, error)
+	// DoWatering waters for given start and watering time in ms and returns
+	// the actual watering time in ms.
+	DoWatering(start, watering int) int
+	// Rotate turns the plate to given angle in degrees.
+	Rotate(angle uint64) error
+	// ReadWateringLimit returns the measured water limit.
+	ReadWateringLimit() (int, error)
+	// ReadLastWatering returns the duration of the last watering in ms.
+	ReadLastWatering() (int, error)
+	// SetRefillInterval sets the refill interval.
+	SetRefillInterval(i uint8) error
+	// ReadRefillInterval returns the currently set refill interval.
+	ReadRefillInterval() (int, error)
+	// Echo sends given data to the controller and returns its reply.
+	Echo(buf []byte) ([]byte, error)
+}
+
+type controllerConfig struct {
+	// Type selects the controller, either "wuc", "sim" or "replay" for
+	// the Wuc driver replaying an i2c trace.
+	Type string
+	Sim  simConfig
+	// Record is the file i2c traffic of the Wuc is recorded to.
+	Record string
+	// Trace is the i2c trace file replayed.
+	Trace string
+}
+
+// newController creates the configured controller and returns it with the
+// clock the station runs on, which is the replayed trace for "replay".
+func newController(c controllerConfig, clk clock) (Controller, clock, error) {
+	switch c.Type {
+	case "", "wuc":
+		var conn i2c.Connector = raspi.NewAdaptor()
+		if c.Record != "" {
+			conn = &recordingConnector{conn, c.Record}
+		}
+		w, err := NewWuc(conn)
+		return w, clk, err
+	case "sim":
+		return NewSimWuc(c.Sim, clk), clk, nil
+	case "replay":
+		r, err := NewReplayConnection(c.Trace)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newWuc(r, r.Sleep), r, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown controller type: %s", c.Type)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A FakeWucConnection emulates the firmware of the Watering Micro Controller
+// behind an i2c.Connection. It runs on a virtual clock which is only advanced
+// by Sleep, so a Wuc created with it runs without real delays.
+type FakeWucConnection struct {
+	mutex sync.Mutex
+	now   time.Time
+
+	// Weight is the raw value returned by the weight sensor.
+	Weight int
+	// WeightFail makes weight measurements fail.
+	WeightFail bool
+	// MeasureTime is the time needed for measuring the weight.
+	MeasureTime time.Duration
+
+	// Limit is the returned water limit.
+	Limit int
+	// LimitFail makes water limit measurements fail.
+	LimitFail bool
+
+	// RotationTime is the time needed for a full revolution of the plate.
+	RotationTime time.Duration
+	// Stuck keeps the motor running until it is stopped.
+	Stuck bool
+	// Uncalibrated clears calibration bit of motor status.
+	Uncalibrated bool
+
+	// MaxWrite limits the number of bytes accepted per write, 0 means no
+	// limit.
+	MaxWrite int
+	// WriteErr and ReadErr are returned on write of or read after the
+	// command of given key.
+	WriteErr map[byte]error
+	ReadErr  map[byte]error
+
+	// Commands contains all commands received.
+	Commands []byte
+
+	reg       byte
+	measured  time.Time
+	position  uint
+	motorStop time.Time
+	stopped   bool
+	// pending watering in units of 250ms
+	wateringStart     byte
+	watering          byte
+	wateringRequested time.Time
+	lastWatering      byte
+	refill            byte
+	echo              []byte
+}
+
+// NewFakeWucConnection creates an emulated firmware with default timings.
+func NewFakeWucConnection() *FakeWucConnection {
+	return &FakeWucConnection{
+		now:          time.Unix(0, 0),
+		Weight:       1450,
+		MeasureTime:  500 * time.Millisecond,
+		Limit:        200,
+		RotationTime: 10 * time.Second,
+		stopped:      true,
+	}
+}
+
+// Sleep advances the virtual clock.
+func (c *FakeWucConnection) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Now returns the virtual time.
+func (c *FakeWucConnection) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *FakeWucConnection) motorRunning() bool {
+	return !c.stopped && (c.Stuck || c.now.Before(c.motorStop))
+}
+
+// update finishes pending watering once motor has stopped.
+func (c *FakeWucConnection) update() {
+	if c.watering == 0 || c.motorRunning() {
+		return
+	}
+	// watering starts after rotation finished
+	start := c.wateringRequested
+	if c.motorStop.After(start) {
+		start = c.motorStop
+	}
+	d := time.Duration(c.wateringStart) + time.Duration(c.watering)
+	if !c.now.Before(start.Add(d * 250 * time.Millisecond)) {
+		c.lastWatering = c.watering
+		c.watering = 0
+	}
+}
+
+// Write handles a command with its arguments.
+func (c *FakeWucConnection) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	cmd := b[0]
+	c.Commands = append(c.Commands, cmd)
+	if err := c.WriteErr[cmd]; err != nil {
+		return 0, err
+	}
+
+	n := len(b)
+	if c.MaxWrite > 0 && n > c.MaxWrite {
+		// firmware ignores incomplete commands
+		return c.MaxWrite, nil
+	}
+
+	c.update()
+	c.reg = cmd
+
+	switch cmd {
+	case cmdGetWeight:
+		c.measured = c.now.Add(c.MeasureTime)
+	case cmdRotate:
+		if n < 3 {
+			return n, nil
+		}
+		a := (uint(b[1]) | uint(b[2])<<8) % CPR
+		d := (a + CPR - c.position) % CPR
+		c.position = a
+		c.stopped = false
+		c.motorStop = c.now.Add(time.Duration(d) * c.RotationTime / CPR)
+		c.reg = cmdGetMotorStatus
+	case cmdStop:
+		if c.motorRunning() {
+			c.motorStop = c.now
+		}
+		c.stopped = true
+		c.update()
+	case cmdWatering:
+		if n < 3 {
+			return n, nil
+		}
+		c.wateringStart = b[1]
+		c.watering = b[2]
+		c.wateringRequested = c.now
+		c.lastWatering = 0
+		c.update()
+	case cmdSetWaterRefill:
+		if n < 2 {
+			return n, nil
+		}
+		c.refill = b[1]
+	case cmdEcho:
+		c.echo = append([]byte(nil), b[1:]...)
+	}
+
+	return n, nil
+}
+
+// WriteByte handles a command without arguments.
+func (c *FakeWucConnection) WriteByte(b byte) error {
+	_, err := c.Write([]byte{b})
+	return err
+}
+
+// Read returns the reply of the last command.
+func (c *FakeWucConnection) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.ReadErr[c.reg]; err != nil {
+		return 0, err
+	}
+
+	c.update()
+
+	var reply []byte
+
+	switch c.reg {
+	case cmdGetWeight:
+		if c.WeightFail || c.now.Before(c.measured) {
+			reply = []byte{0xFF, 0xFF}
+		} else {
+			reply = []byte{byte(c.Weight & 0xFF), byte((c.Weight >> 8) & 0x7F)}
+		}
+	case cmdGetMotorStatus:
+		var feed, status byte
+		if c.motorRunning() {
+			feed = 0xFF
+			status |= 0x80
+		}
+		if !c.Uncalibrated {
+			status |= 0x40
+		}
+		reply = []byte{feed, status}
+	case cmdWatering:
+		if c.watering != 0 {
+			reply = []byte{0}
+		} else {
+			reply = []byte{c.lastWatering}
+		}
+	case cmdGetLastWatering:
+		reply = []byte{c.lastWatering}
+	case cmdGetWaterLimit:
+		if c.LimitFail {
+			reply = []byte{0xFF}
+		} else {
+			reply = []byte{byte(c.Limit)}
+		}
+	case cmdGetWaterRefill:
+		reply = []byte{c.refill}
+	case cmdEcho:
+		reply = c.echo
+	default:
+		return 0, fmt.Errorf("no reply for command 0x%02x", c.reg)
+	}
+
+	return copy(b, reply), nil
+}
+
+// ReadByte returns first byte of the reply of the last command.
+func (c *FakeWucConnection) ReadByte() (byte, error) {
+	var b [1]byte
+	n, err := c.Read(b[:])
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("empty reply")
+	}
+	return b[0], nil
+}
+
+// ReadByteData is not supported by the firmware.
+func (c *FakeWucConnection) ReadByteData(reg uint8) (uint8, error) {
+	return 0, fmt.Errorf("register access not supported")
+}
+
+// ReadWordData is not supported by the firmware.
+func (c *FakeWucConnection) ReadWordData(reg uint8) (uint16, error) {
+	return 0, fmt.Errorf("register access not supported")
+}
+
+// WriteByteData is not supported by the firmware.
+func (c *FakeWucConnection) WriteByteData(reg uint8, val uint8) error {
+	return fmt.Errorf("register access not supported")
+}
+
+// WriteWordData is not supported by the firmware.
+func (c *FakeWucConnection) WriteWordData(reg uint8, val uint16) error {
+	return fmt.Errorf("register access not supported")
+}
+
+// WriteBlockData is not supported by the firmware.
+func (c *FakeWucConnection) WriteBlockData(reg uint8, b []byte) error {
+	return fmt.Errorf("register access not supported")
+}
+
+// Close does nothing.
+func (c *FakeWucConnection) Close() error {
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// hassDevice describes the station in Home Assistant discovery configs.
+type hassDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// hassEntity is a Home Assistant MQTT discovery config.
+type hassEntity struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	StateTopic        string     `json:"state_topic,omitempty"`
+	ValueTemplate     string     `json:"value_template,omitempty"`
+	CommandTopic      string     `json:"command_topic,omitempty"`
+	CommandTemplate   string     `json:"command_template,omitempty"`
+	UnitOfMeasurement string     `json:"unit_of_measurement,omitempty"`
+	StateClass        string     `json:"state_class,omitempty"`
+	Icon              string     `json:"icon,omitempty"`
+	Min               *int       `json:"min,omitempty"`
+	Max               *int       `json:"max,omitempty"`
+	Step              int        `json:"step,omitempty"`
+	Mode              string     `json:"mode,omitempty"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	Device            hassDevice `json:"device"`
+
+	// component is the Home Assistant platform of the entity.
+	component string
+}
+
+func (s *station) availabilityTopic() string {
+	return s.MQTT.Topic + "/status"
+}
+
+// hassEntities returns the discovery configs of all entities of station.
+func (s *station) hassEntities() []hassEntity {
+	id := s.MQTT.ClientID
+	if id == "" {
+		id = s.MQTT.Topic
+	}
+	id = strings.NewReplacer("/", "_", " ", "_", "#", "_", "+", "_").Replace(id)
+
+	dev := hassDevice{
+		Identifiers:  []string{id},
+		Name:         fmt.Sprintf("Plant %s", id),
+		Manufacturer: "plantcare",
+		Model:        "Plant Care Station",
+	}
+
+	s.mutex.RLock()
+	maxWater := s.Config.MaxWater
+	weightUnit := ""
+	if s.Calibration.calibrated() {
+		weightUnit = "g"
+	}
+	s.mutex.RUnlock()
+
+	t := s.MQTT.Topic
+	intp := func(i int) *int { return &i }
+
+	entities := []hassEntity{
+		{
+			component:         "sensor",
+			Name:              "Weight",
+			StateTopic:        t + "/weight",
+			UnitOfMeasurement: weightUnit,
+			StateClass:        "measurement",
+			Icon:              "mdi:weight",
+		},
+		{
+			component:         "sensor",
+			Name:              "Last Watering",
+			StateTopic:        t + "/water",
+			UnitOfMeasurement: "ms",
+			Icon:              "mdi:watering-can",
+		},
+		{
+			component:  "sensor",
+			Name:       "Water Limit",
+			StateTopic: t + "/limit",
+			StateClass: "measurement",
+			Icon:       "mdi:cup-water",
+		},
+		{
+			component:         "sensor",
+			Name:              "Reservoir Days",
+			StateTopic:        t + "/reservoir",
+			ValueTemplate:     "{{ value_json.days | round(1) }}",
+			UnitOfMeasurement: "d",
+			StateClass:        "measurement",
+			Icon:              "mdi:calendar-clock",
+		},
+		{
+			component:     "binary_sensor",
+			Name:          "Reservoir Alarm",
+			StateTopic:    t + "/reservoir",
+			ValueTemplate: "{{ 'ON' if value_json.alarm else 'OFF' }}",
+			Icon:          "mdi:water-alert",
+		},
+		{
+			component:     "binary_sensor",
+			Name:          "Weight Sensor Problem",
+			StateTopic:    t + "/alarm/sensor",
+			ValueTemplate: "{{ 'ON' if value_json.state else 'OFF' }}",
+			Icon:          "mdi:scale-off",
+		},
+		{
+			component:     "sensor",
+			Name:          "Dryout",
+			StateTopic:    t + "/model",
+			ValueTemplate: "{{ value_json.dryout }}",
+			StateClass:    "measurement",
+			Icon:          "mdi:water-minus",
+		},
+		{
+			component:     "sensor",
+			Name:          "Watering Scale",
+			StateTopic:    t + "/model",
+			ValueTemplate: "{{ value_json.scale }}",
+			Icon:          "mdi:chart-line",
+		},
+		{
+			component:         "sensor",
+			Name:              "Watering Offset",
+			StateTopic:        t + "/model",
+			ValueTemplate:     "{{ value_json.offset }}",
+			UnitOfMeasurement: "ms",
+			Icon:              "mdi:chart-line",
+		},
+		{
+			component:         "number",
+			Name:              "Water",
+			CommandTopic:      t + "/cmd/water",
+			CommandTemplate:   `{"id": "hass", "time": {{ value }} }`,
+			UnitOfMeasurement: "ms",
+			Min:               intp(0),
+			Max:               intp(maxWater),
+			Step:              250,
+			Mode:              "box",
+			Icon:              "mdi:watering-can",
+		},
+		{
+			component:       "number",
+			Name:            "Rotation",
+			CommandTopic:    t + "/cmd/rotate",
+			CommandTemplate: `{"id": "hass", "angle": {{ value }} }`,
+			Min:             intp(0),
+			Max:             intp(359),
+			Step:            1,
+			Mode:            "slider",
+			Icon:            "mdi:rotate-right",
+		},
+	}
+
+	for i := range entities {
+		e := &entities[i]
+		e.UniqueID = fmt.Sprintf("%s_%s", id,
+			strings.ToLower(strings.Replace(e.Name, " ", "_", -1)))
+		e.AvailabilityTopic = s.availabilityTopic()
+		e.Device = dev
+	}
+
+	return entities
+}
+
+// publishDiscovery publishes Home Assistant discovery configs.
+func (s *station) publishDiscovery() {
+	prefix := s.MQTT.DiscoveryPrefix
+	if prefix == "" {
+		prefix = "homeassistant"
+	}
+
+	for _, e := range s.hassEntities() {
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("failed to marshal discovery config of %s: %v", e.Name, err)
+			continue
+		}
+
+		topic := fmt.Sprintf("%s/%s/%s/config", prefix, e.component, e.UniqueID)
+		if err := s.publish(topic, byte(1), true, string(b)); err != nil {
+			log.Printf("failed to publish discovery config of %s: %v", e.Name, err)
+		}
+	}
+}
+
+// publishState updates metrics and publishes hourly state of station: water
+// limit and watering model.
+func (s *station) publishState() {
+	s.mutex.RLock()
+	l := s.Reservoir.Level
+	s.mutex.RUnlock()
+	if l >= 0 {
+		s.metrics.setWaterLimit(l)
+		s.publish(s.MQTT.Topic+"/limit", byte(0), true, fmt.Sprint(l))
+	}
+
+	dryout, wts, wto := s.calculateDryoutAndWateringTime()
+	s.metrics.setModel(dryout, wts, wto)
+	b, err := json.Marshal(map[string]int{
+		"dryout": dryout,
+		"scale":  wts,
+		"offset": wto,
+	})
+	if err != nil {
+		log.Printf("failed to marshal model: %v", err)
+		return
+	}
+	s.publish(s.MQTT.Topic+"/model", byte(0), true, string(b))
+}
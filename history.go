@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historyHour   = "hour"
+	historyMinute = "minute"
+)
+
+// historySample is a single sample of the long-term history.
+type historySample struct {
+	// Time is the unix time of the sample.
+	Time   int64 `json:"t"`
+	Weight int   `json:"w"`
+	// Raw is the raw load cell count of weight, 0 if not read directly.
+	Raw      int `json:"raw,omitempty"`
+	Watering int `json:"water,omitempty"`
+	// Shadow is the watering skipped in dry run.
+	Shadow int `json:"shadow,omitempty"`
+	// Suppressed is the watering skipped as unsafe.
+	Suppressed int `json:"suppressed,omitempty"`
+	Quality    int `json:"q,omitempty"`
+	// CatchUp is set if watering was evaluated late for a missed hour.
+	CatchUp bool `json:"catchup,omitempty"`
+	// Reservoir is the reservoir level, nil if unknown.
+	Reservoir *int `json:"res,omitempty"`
+	// Cal is the time of the calibration weight is in, 0 for uncalibrated
+	// counts.
+	Cal int64 `json:"cal,omitempty"`
+}
+
+// A History is an append-only store of hourly and minute samples.
+// Samples are appended as JSON lines to one file per month for hourly and
+// one file per day for minute samples.
+type History struct {
+	// mutex serializes appending with rewriting of files
+	mutex sync.Mutex
+	dir   string
+	// days minute samples are kept in full resolution
+	minuteRetention int
+	// minutes minute samples are downsampled to after retention
+	minuteDownsample int
+	// days hourly and downsampled samples are kept, 0 keeps them forever
+	hourRetention int
+}
+
+// NewHistory creates History in directory of given files config.
+func NewHistory(c filesConfig) (*History, error) {
+	if err := os.MkdirAll(c.History, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory %s: %v", c.History, err)
+	}
+
+	return &History{
+		dir:              c.History,
+		minuteRetention:  c.MinuteRetention,
+		minuteDownsample: c.MinuteDownsample,
+		hourRetention:    c.HourRetention,
+	}, nil
+}
+
+func (h *History) fileName(res string, t time.Time) string {
+	t = t.UTC()
+	if res == historyHour {
+		return filepath.Join(h.dir, fmt.Sprintf("hour-%s.jsonl", t.Format("200601")))
+	}
+	return filepath.Join(h.dir, fmt.Sprintf("minute-%s.jsonl", t.Format("20060102")))
+}
+
+// fileTime parses the period start and end of a history file name.
+func fileTime(name string) (res string, start, end time.Time, ok bool) {
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), ".jsonl"), ".ds")
+	i := strings.IndexByte(base, '-')
+	if i < 0 {
+		return
+	}
+	res = base[:i]
+	var err error
+	switch res {
+	case historyHour:
+		start, err = time.Parse("200601", base[i+1:])
+		end = start.AddDate(0, 1, 0)
+	case historyMinute:
+		start, err = time.Parse("20060102", base[i+1:])
+		end = start.AddDate(0, 0, 1)
+	default:
+		return
+	}
+	ok = err == nil
+	return
+}
+
+func appendSamples(file string, samples []historySample) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, s := range samples {
+		if err = enc.Encode(s); err != nil {
+			break
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func readSamples(file string) ([]historySample, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var samples []historySample
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var s historySample
+		if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+			// skip lines cut off by power loss
+			log.Printf("skipping invalid history sample in %s: %v", file, err)
+			continue
+		}
+		samples = append(samples, s)
+	}
+
+	return samples, sc.Err()
+}
+
+// AddHour appends an hourly sample.
+func (h *History) AddHour(s historySample) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return appendSamples(h.fileName(historyHour, time.Unix(s.Time, 0)), []historySample{s})
+}
+
+// AddMinute appends a minute sample with weight in calibration cal, raw
+// count and quality.
+func (h *History) AddMinute(t time.Time, weight, raw, quality int, cal int64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return appendSamples(h.fileName(historyMinute, t), []historySample{{
+		Time:    t.Unix(),
+		Weight:  weight,
+		Raw:     raw,
+		Quality: quality,
+		Cal:     cal,
+	}})
+}
+
+// Convert rewrites the samples of all files with conv.
+func (h *History) Convert(conv func(s historySample) historySample) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		if _, _, _, ok := fileTime(fi.Name()); !ok {
+			continue
+		}
+
+		file := filepath.Join(h.dir, fi.Name())
+		samples, err := readSamples(file)
+		if err != nil {
+			return err
+		}
+		for i, s := range samples {
+			samples[i] = conv(s)
+		}
+
+		tmp := file + ".tmp"
+		os.Remove(tmp)
+		if err := appendSamples(tmp, samples); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read returns samples of given resolution in time range [from, to).
+func (h *History) Read(res string, from, to time.Time) ([]historySample, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []historySample
+	for _, fi := range files {
+		r, start, end, ok := fileTime(fi.Name())
+		if !ok || r != res || !end.After(from) || !start.Before(to) {
+			continue
+		}
+
+		s, err := readSamples(filepath.Join(h.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range s {
+			if v.Time >= from.Unix() && v.Time < to.Unix() {
+				samples = append(samples, v)
+			}
+		}
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time < samples[j].Time
+	})
+
+	return samples, nil
+}
+
+// Compact applies retention policy: minute files older than minute
+// retention are downsampled or removed, files older than hour retention
+// are removed.
+func (h *History) Compact(now time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		res, _, end, ok := fileTime(fi.Name())
+		if !ok {
+			continue
+		}
+
+		file := filepath.Join(h.dir, fi.Name())
+		age := int(now.Sub(end).Hours() / 24)
+
+		if h.hourRetention > 0 && age >= h.hourRetention {
+			log.Printf("removing expired history %s", file)
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if res != historyMinute || strings.HasSuffix(fi.Name(), ".ds.jsonl") ||
+			h.minuteRetention <= 0 || age < h.minuteRetention {
+			continue
+		}
+
+		if h.minuteDownsample > 0 {
+			log.Printf("downsampling history %s", file)
+			if err := h.downsample(file); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// downsample writes medians of minute samples of file per downsampling
+// interval to a .ds file. Samples not measured, e.g. taken during a
+// calibration, are skipped.
+func (h *History) downsample(file string) error {
+	samples, err := readSamples(file)
+	if err != nil {
+		return err
+	}
+
+	interval := int64(h.minuteDownsample * 60)
+	var result []historySample
+	var bucket []int
+	var bucketTime, bucketCal int64
+
+	flush := func() {
+		if len(bucket) > 0 {
+			sort.Ints(bucket)
+			result = append(result, historySample{
+				Time:   bucketTime,
+				Weight: bucket[len(bucket)/2],
+				Cal:    bucketCal,
+			})
+		}
+		bucket = bucket[:0]
+	}
+
+	for _, s := range samples {
+		if s.Quality != qualityMeasured {
+			continue
+		}
+		t := s.Time - s.Time%interval
+		if t != bucketTime || s.Cal != bucketCal {
+			flush()
+			bucketTime = t
+			bucketCal = s.Cal
+		}
+		bucket = append(bucket, s.Weight)
+	}
+	flush()
+
+	dst := strings.TrimSuffix(file, ".jsonl") + ".ds.jsonl"
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	if err := appendSamples(tmp, result); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDownsample(t *testing.T) {
+	h := &History{dir: t.TempDir(), minuteDownsample: 10}
+	file := filepath.Join(h.dir, "minute-20200101.jsonl")
+
+	var samples []historySample
+	for m := int64(0); m < 20; m++ {
+		s := historySample{Time: 1577836800 + m*60, Weight: 1400 + int(m)}
+		if m%10 < 4 {
+			// pot emptied for calibration
+			s.Weight = 0
+			s.Quality = qualityCalibrating
+		}
+		samples = append(samples, s)
+	}
+	if err := appendSamples(file, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.downsample(file); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSamples(filepath.Join(h.dir, "minute-20200101.ds.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []historySample{
+		{Time: 1577836800, Weight: 1407},
+		{Time: 1577837400, Weight: 1417},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("downsampled to %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/drivers/i2c"
+)
+
+// i2cTraceEntry is a single operation on an i2c.Connection.
+type i2cTraceEntry struct {
+	// Time is the unix time in ns when operation finished.
+	Time int64  `json:"t"`
+	Op   string `json:"op"`
+	// Reg is the register of register based operations.
+	Reg uint8 `json:"reg,omitempty"`
+	// Data is the hex encoded data written or read.
+	Data string `json:"data,omitempty"`
+	// N is the number of bytes transferred.
+	N   int    `json:"n"`
+	Err string `json:"err,omitempty"`
+}
+
+// A recordingConnector wraps the connections of a Connector with a
+// RecordingConnection.
+type recordingConnector struct {
+	i2c.Connector
+	file string
+}
+
+func (c *recordingConnector) GetConnection(address int, bus int) (i2c.Connection, error) {
+	conn, err := c.Connector.GetConnection(address, bus)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecordingConnection(conn, c.file)
+}
+
+// A RecordingConnection writes all operations on an i2c.Connection with
+// timestamps to a trace file.
+type RecordingConnection struct {
+	conn  i2c.Connection
+	now   func() time.Time
+	mutex sync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+}
+
+// NewRecordingConnection creates a RecordingConnection appending to file.
+func NewRecordingConnection(conn i2c.Connection, file string) (*RecordingConnection, error) {
+	return newRecordingConnection(conn, file, time.Now)
+}
+
+// newRecordingConnection creates a RecordingConnection taking the times of
+// the recorded operations from now.
+func newRecordingConnection(conn i2c.Connection, file string, now func() time.Time) (*RecordingConnection, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open i2c trace %s: %v", file, err)
+	}
+
+	log.Printf("recording i2c traffic to %s", file)
+
+	return &RecordingConnection{
+		conn: conn,
+		now:  now,
+		file: f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+func (c *RecordingConnection) record(op string, reg uint8, data []byte, n int, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e := i2cTraceEntry{
+		Time: c.now().UnixNano(),
+		Op:   op,
+		Reg:  reg,
+		Data: hex.EncodeToString(data),
+		N:    n,
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+
+	if err := c.enc.Encode(e); err != nil {
+		log.Printf("failed to record i2c %s: %v", op, err)
+	}
+}
+
+// recordRead records read data, or only the error if the read failed.
+func (c *RecordingConnection) recordRead(op string, reg uint8, data []byte, err error) {
+	if err != nil {
+		data = nil
+	}
+	c.record(op, reg, data, len(data), err)
+}
+
+// Read reads from connection and records result.
+func (c *RecordingConnection) Read(b []byte) (int, error) {
+	n, err := c.conn.Read(b)
+	if n >= 0 && n <= len(b) {
+		c.record("Read", 0, b[:n], n, err)
+	} else {
+		c.record("Read", 0, nil, n, err)
+	}
+	return n, err
+}
+
+// Write writes to connection and records data.
+func (c *RecordingConnection) Write(b []byte) (int, error) {
+	n, err := c.conn.Write(b)
+	c.record("Write", 0, b, n, err)
+	return n, err
+}
+
+// ReadByte reads a byte from connection and records it.
+func (c *RecordingConnection) ReadByte() (byte, error) {
+	v, err := c.conn.ReadByte()
+	c.recordRead("ReadByte", 0, []byte{v}, err)
+	return v, err
+}
+
+// WriteByte writes a byte to connection and records it.
+func (c *RecordingConnection) WriteByte(v byte) error {
+	err := c.conn.WriteByte(v)
+	c.record("WriteByte", 0, []byte{v}, 1, err)
+	return err
+}
+
+// ReadByteData reads a register and records result.
+func (c *RecordingConnection) ReadByteData(reg uint8) (uint8, error) {
+	v, err := c.conn.ReadByteData(reg)
+	c.recordRead("ReadByteData", reg, []byte{v}, err)
+	return v, err
+}
+
+// ReadWordData reads a register and records result.
+func (c *RecordingConnection) ReadWordData(reg uint8) (uint16, error) {
+	v, err := c.conn.ReadWordData(reg)
+	c.recordRead("ReadWordData", reg, []byte{byte(v), byte(v >> 8)}, err)
+	return v, err
+}
+
+// WriteByteData writes a register and records it.
+func (c *RecordingConnection) WriteByteData(reg uint8, v uint8) error {
+	err := c.conn.WriteByteData(reg, v)
+	c.record("WriteByteData", reg, []byte{v}, 1, err)
+	return err
+}
+
+// WriteWordData writes a register and records it.
+func (c *RecordingConnection) WriteWordData(reg uint8, v uint16) error {
+	err := c.conn.WriteWordData(reg, v)
+	c.record("WriteWordData", reg, []byte{byte(v), byte(v >> 8)}, 2, err)
+	return err
+}
+
+// WriteBlockData writes a block and records it.
+func (c *RecordingConnection) WriteBlockData(reg uint8, b []byte) error {
+	err := c.conn.WriteBlockData(reg, b)
+	c.record("WriteBlockData", reg, b, len(b), err)
+	return err
+}
+
+// Close closes connection and trace file.
+func (c *RecordingConnection) Close() error {
+	c.mutex.Lock()
+	c.file.Close()
+	c.mutex.Unlock()
+	return c.conn.Close()
+}
+
+// A ReplayConnection plays back a trace written by a RecordingConnection.
+// Each operation consumes the next entry of the trace, written data is
+// compared to the recorded data. It is the clock of the replaying station,
+// so jobs run at the recorded times.
+type ReplayConnection struct {
+	mutex   sync.Mutex
+	entries []i2cTraceEntry
+	next    int
+	// now is the time advanced by Sleep
+	now time.Time
+}
+
+// NewReplayConnection reads trace from file.
+func NewReplayConnection(file string) (*ReplayConnection, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open i2c trace %s: %v", file, err)
+	}
+	defer f.Close()
+
+	c := &ReplayConnection{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e i2cTraceEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// a cut off last line is expected from a power cut
+			log.Printf("i2c trace %s truncated after %d entries: %v",
+				file, len(c.entries), err)
+			break
+		}
+		c.entries = append(c.entries, e)
+	}
+
+	log.Printf("replaying %d i2c operations from %s", len(c.entries), file)
+
+	return c, nil
+}
+
+// Sleep advances the replay time without delay.
+func (c *ReplayConnection) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if d > 0 {
+		c.now = c.time().Add(d)
+	}
+}
+
+// Now returns the replay time.
+func (c *ReplayConnection) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.time()
+}
+
+// time returns the time advanced by Sleep, but not before the last replayed
+// operation and a second before the minute of the next operation, so the
+// job which performed it runs next. Gaps in the trace, e.g. while the
+// station was down, are skipped. Must be called with locked mutex.
+func (c *ReplayConnection) time() time.Time {
+	t := c.now
+	if c.next > 0 {
+		if last := time.Unix(0, c.entries[c.next-1].Time); last.After(t) {
+			t = last
+		}
+	}
+	if c.next < len(c.entries) {
+		next := time.Unix(0, c.entries[c.next].Time).Truncate(time.Minute).Add(-time.Second)
+		if next.After(t) {
+			t = next
+		}
+	}
+	return t
+}
+
+// End returns the time of the last operation of the trace, zero if the
+// trace is empty.
+func (c *ReplayConnection) End() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, c.entries[len(c.entries)-1].Time)
+}
+
+// Done reports whether all entries of the trace have been replayed.
+func (c *ReplayConnection) Done() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.next >= len(c.entries)
+}
+
+// replay consumes next entry, checks operation and written data and
+// returns read data.
+func (c *ReplayConnection) replay(op string, reg uint8, written []byte) ([]byte, int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.next >= len(c.entries) {
+		return nil, 0, io.EOF
+	}
+
+	e := c.entries[c.next]
+	if e.Op != op || e.Reg != reg {
+		return nil, 0, fmt.Errorf("i2c trace mismatch at %d: expected %s(%d), got %s(%d)",
+			c.next, e.Op, e.Reg, op, reg)
+	}
+
+	data, err := hex.DecodeString(e.Data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid data in i2c trace at %d: %v", c.next, err)
+	}
+
+	if written != nil && hex.EncodeToString(written) != e.Data {
+		return nil, 0, fmt.Errorf("i2c trace mismatch at %d: expected %s to write %s, got %x",
+			c.next, op, e.Data, written)
+	}
+
+	c.next++
+
+	if e.Err != "" {
+		err = errors.New(e.Err)
+	}
+
+	return data, e.N, err
+}
+
+// Read returns recorded read data.
+func (c *ReplayConnection) Read(b []byte) (int, error) {
+	data, n, err := c.replay("Read", 0, nil)
+	copy(b, data)
+	return n, err
+}
+
+// Write checks data against recorded write.
+func (c *ReplayConnection) Write(b []byte) (int, error) {
+	_, n, err := c.replay("Write", 0, b)
+	return n, err
+}
+
+// ReadByte returns recorded byte.
+func (c *ReplayConnection) ReadByte() (byte, error) {
+	data, _, err := c.replay("ReadByte", 0, nil)
+	if len(data) < 1 {
+		return 0, err
+	}
+	return data[0], err
+}
+
+// WriteByte checks byte against recorded write.
+func (c *ReplayConnection) WriteByte(v byte) error {
+	_, _, err := c.replay("WriteByte", 0, []byte{v})
+	return err
+}
+
+// ReadByteData returns recorded register value.
+func (c *ReplayConnection) ReadByteData(reg uint8) (uint8, error) {
+	data, _, err := c.replay("ReadByteData", reg, nil)
+	if len(data) < 1 {
+		return 0, err
+	}
+	return data[0], err
+}
+
+// ReadWordData returns recorded register value.
+func (c *ReplayConnection) ReadWordData(reg uint8) (uint16, error) {
+	data, _, err := c.replay("ReadWordData", reg, nil)
+	if len(data) < 2 {
+		return 0, err
+	}
+	return uint16(data[0]) | uint16(data[1])<<8, err
+}
+
+// WriteByteData checks value against recorded write.
+func (c *ReplayConnection) WriteByteData(reg uint8, v uint8) error {
+	_, _, err := c.replay("WriteByteData", reg, []byte{v})
+	return err
+}
+
+// WriteWordData checks value against recorded write.
+func (c *ReplayConnection) WriteWordData(reg uint8, v uint16) error {
+	_, _, err := c.replay("WriteWordData", reg, []byte{byte(v), byte(v >> 8)})
+	return err
+}
+
+// WriteBlockData checks block against recorded write.
+func (c *ReplayConnection) WriteBlockData(reg uint8, b []byte) error {
+	_, _, err := c.replay("WriteBlockData", reg, b)
+	return err
+}
+
+// Close does nothing.
+func (c *ReplayConnection) Close() error {
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTraceStation returns a station on given clock without files, MQTT and
+// camera, controlled by Wuc w.
+func newTraceStation(w *Wuc, clk clock) *station {
+	c := defaultPlantConfig
+	c.WaterHour = 2
+	// no camera to take pictures with
+	c.UpdateHour = -1
+	s := &station{
+		Config:  c,
+		clock:   clk,
+		metrics: newMetrics(),
+	}
+	s.WateringTimeData.Scale = 100
+	s.wuc = &instrumentedController{w, s.metrics}
+	s.scheduler = s.newScheduler()
+	return s
+}
+
+func TestRecordReplay(t *testing.T) {
+	setLocal(t, time.UTC)
+
+	trace := filepath.Join(t.TempDir(), "trace.json")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// record station watering a dry pot
+	f := NewFakeWucConnection()
+	f.now = start
+	f.Weight = 1300
+	rec, err := newRecordingConnection(f, trace, f.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := newTraceStation(newWuc(rec, f.Sleep), f)
+	recorded.runUntil(start.Add(3 * time.Hour))
+	rec.Close()
+
+	if n := len(recorded.Data.Weight); n != 3 {
+		t.Fatalf("recorded %d hours, want 3", n)
+	}
+	watered := false
+	for _, w := range recorded.Data.Watering {
+		watered = watered || w > 0
+	}
+	if !watered {
+		t.Fatal("no watering recorded")
+	}
+
+	// replay on the clock of the trace
+	r, err := NewReplayConnection(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := newTraceStation(newWuc(r, r.Sleep), r)
+	if !replayed.run() {
+		t.Fatal("trace not replayed")
+	}
+
+	if !r.Done() {
+		t.Errorf("trace not replayed completely at %v", r.Now())
+	}
+	if !reflect.DeepEqual(replayed.Data, recorded.Data) {
+		t.Errorf("replayed data %+v, want %+v", replayed.Data, recorded.Data)
+	}
+	if !reflect.DeepEqual(replayed.MinData, recorded.MinData) {
+		t.Errorf("replayed minute data differs")
+	}
+}
+
+func TestRecordReplayWuc(t *testing.T) {
+	trace := filepath.Join(t.TempDir(), "trace.json")
+
+	f := NewFakeWucConnection()
+	f.ReadErr = map[byte]error{cmdGetWaterLimit: errors.New("nack")}
+	rec, err := newRecordingConnection(f, trace, f.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWuc(rec, f.Sleep)
+	weight, err := w.ReadWeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	watered := w.DoWatering(0, 2000)
+	if _, err := w.ReadWateringLimit(); err == nil {
+		t.Fatal("no error on failed read")
+	}
+	rec.Close()
+
+	// failed read is recorded without data
+	b, err := os.ReadFile(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var e i2cTraceEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Op != "ReadByte" || e.N != 0 || e.Data != "" || e.Err != "nack" {
+		t.Errorf("failed read recorded as %+v", e)
+	}
+
+	r, err := NewReplayConnection(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := newWuc(r, r.Sleep)
+	if v, err := rw.ReadWeight(); err != nil || v != weight {
+		t.Errorf("replayed weight %v, %v, want %v", v, err, weight)
+	}
+	if v := rw.DoWatering(0, 2000); v != watered {
+		t.Errorf("replayed watering %v, want %v", v, watered)
+	}
+	if _, err := rw.ReadWateringLimit(); err == nil || err.Error() != "nack" {
+		t.Errorf("replayed limit error %v, want nack", err)
+	}
+	if !r.Done() {
+		t.Error("trace not replayed completely")
+	}
+}
+
+func TestReplaySkipsGap(t *testing.T) {
+	trace := filepath.Join(t.TempDir(), "trace.json")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	f := NewFakeWucConnection()
+	f.now = start
+	rec, err := newRecordingConnection(f, trace, f.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWuc(rec, f.Sleep)
+	if _, err := w.ReadWeight(); err != nil {
+		t.Fatal(err)
+	}
+	// station down for three hours
+	f.Sleep(3*time.Hour + 30*time.Second)
+	if _, err := w.ReadWeight(); err != nil {
+		t.Fatal(err)
+	}
+	rec.Close()
+
+	r, err := NewReplayConnection(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now := r.Now(); !now.Equal(start.Add(-time.Second)) {
+		t.Errorf("replay starts at %v, want %v", now, start.Add(-time.Second))
+	}
+	rw := newWuc(r, r.Sleep)
+	if _, err := rw.ReadWeight(); err != nil {
+		t.Fatal(err)
+	}
+	want := start.Add(3*time.Hour - time.Second)
+	if now := r.Now(); !now.Equal(want) {
+		t.Errorf("replay continues at %v, want %v", now, want)
+	}
+	if _, err := rw.ReadWeight(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Done() {
+		t.Error("trace not replayed completely")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -21,7 +22,6 @@ import (
 	"github.com/BurntSushi/toml"
 
 	auth "github.com/abbot/go-http-auth"
-	"gobot.io/x/gobot/platforms/raspi"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
@@ -34,29 +34,82 @@ type station struct {
 	MinData          measurementData  `json:"mindata"`
 	Config           plantConfig      `json:"config"`
 	WateringTimeData wateringTimeData `json:"watertime"`
+	Reservoir        reservoirStatus  `json:"reservoir"`
+	Calibration      calibration      `json:"calibration"`
+	Sensor           sensorHealth     `json:"sensor"`
 
 	mutex         sync.RWMutex
+	clock         clock
 	whitelistNets []net.IPNet
-	wuc           *Wuc
+	wuc           Controller
 	cam           *PiCam
-	serverConfig  `json:"-"`
+	history       *History
+	metrics       *metrics
+	alerts        *alertManager
+	// calibrationSession is the guided calibration in progress.
+	calibrationSession *calibrationSession
+	serverConfig       `json:"-"`
+	// serverConfigFile is the file serverConfig is read from.
+	serverConfigFile string
 
 	pushCh chan<- bool
 
-	mqttClient MQTT.Client
+	// busy is the number of operations disturbing the weight in progress,
+	// settled the time the last one settles.
+	busy    int
+	settled time.Time
+	// models are the recent model fits.
+	models []modelFit
+
+	mqtt *mqttPublisher
+	// scheduler runs the periodic jobs, it is set up before the station
+	// runs and not replaced while handlers read it.
+	scheduler *scheduler
 }
 
 type wateringTimeData struct {
 	Scale  int `json:"scale"`
 	Offset int `json:"offset"`
+	// Since is the unix time learning was reset at, samples before are not
+	// fitted.
+	Since int64 `json:"since,omitempty"`
 }
 
 type measurementData struct {
 	Weight   []int `json:"weight"`
 	Watering []int `json:"water"`
-	Time     int   `json:"time"`
+	// Shadow contains waterings calculated but skipped in dry run.
+	Shadow []int `json:"shadow,omitempty"`
+	// Suppressed contains waterings calculated but skipped as unsafe, for
+	// a failed weight sensor or an empty reservoir.
+	Suppressed []int `json:"suppressed,omitempty"`
+	// Times contains the unix time of each sample.
+	Times []int64 `json:"times"`
+	// Quality contains the quality flag of each sample.
+	Quality []int `json:"quality"`
+	// Reservoir contains the reservoir level of each sample, -1 if
+	// unknown.
+	Reservoir []int `json:"reservoir,omitempty"`
+	// CatchUp contains the unix times of samples with catch-up waterings.
+	CatchUp []int64 `json:"catchup,omitempty"`
+	Time    int     `json:"time"`
 }
 
+// quality flags of measurement samples
+const (
+	qualityMeasured = iota
+	// last known value used because of failed measurement
+	qualityFallback
+	// value filled in for a missed sample
+	qualityInterpolated
+	// sample taken during a guided calibration
+	qualityCalibrating
+	// median of recent samples replacing a rejected spike
+	qualityOutlier
+	// sample taken while rotating or watering or settling afterwards
+	qualityBusy
+)
+
 type plantConfig struct {
 	WaterHour        int  `json:"waterhour"`
 	WaterStart       int  `json:"start"`
@@ -67,6 +120,31 @@ type plantConfig struct {
 	LevelRange       int  `json:"range"`
 	UpdateHour       int  `json:"updatehour"`
 	FixedOrientation *int `json:"orientation"`
+	// Strategy is the watering strategy: "adaptive", "schedule", "band" or
+	// "soakdry".
+	Strategy string `json:"strategy"`
+	// ScheduleDays and ScheduleTime are interval and watering time in ms
+	// of schedule strategy.
+	ScheduleDays int `json:"scheduledays"`
+	ScheduleTime int `json:"scheduletime"`
+	// DryRun calculates waterings without watering.
+	DryRun bool `json:"dryrun"`
+	// CatchUp is the grace period in hours a missed watering hour is
+	// evaluated late, 0 disables catching up.
+	CatchUp int `json:"catchup"`
+	// ReservoirLow and ReservoirDays are the reservoir level and the
+	// estimated remaining days raising the low reservoir alarm.
+	ReservoirLow  int `json:"reservoirlow"`
+	ReservoirDays int `json:"reservoirdays"`
+	// ReservoirSafe is the lowest reservoir level the pump runs safely at,
+	// watering is suppressed below.
+	ReservoirSafe int `json:"reservoirsafe"`
+	// Windows are the hours of the day watering is evaluated at, empty
+	// for a single window at WaterHour.
+	Windows []wateringWindow `json:"windows"`
+	// Model pins watering time scale and offset, nil for the learned
+	// model.
+	Model *wateringTimeData `json:"model"`
 }
 
 type loginConfig struct {
@@ -81,11 +159,31 @@ type httpConfig struct {
 }
 
 type filesConfig struct {
-	Config     string
-	Data       string
-	WaterTime  string
+	Config    string
+	Data      string
+	WaterTime string
+	// Model is the file the history of model fits is kept in.
+	Model      string
 	Pictures   string
 	PushScript string
+	// Calibration is the file the weight calibration is stored in.
+	Calibration string
+	// Temperature is a sysfs file with temperature in millidegrees for
+	// temperature compensation of weight, empty disables it.
+	Temperature string
+	// Outbox is the file undelivered MQTT messages are kept in.
+	Outbox string
+	// History is the directory of the long-term history, empty disables it.
+	History string
+	// MinuteRetention is the number of days minute samples are kept in
+	// full resolution, 0 keeps them forever.
+	MinuteRetention int
+	// MinuteDownsample is the interval in minutes minute samples are
+	// downsampled to after retention, 0 removes them.
+	MinuteDownsample int
+	// HourRetention is the number of days hourly and downsampled samples
+	// are kept, 0 keeps them forever.
+	HourRetention int
 }
 
 type mqttConfig struct {
@@ -94,27 +192,61 @@ type mqttConfig struct {
 	ClientID string
 	User     string
 	Pass     string
+	// Discovery enables publishing of Home Assistant discovery configs.
+	Discovery bool
+	// DiscoveryPrefix is the Home Assistant discovery prefix.
+	DiscoveryPrefix string
+	// CA is the CA certificate file for verifying the broker.
+	CA string
+	// Cert and Key are the client certificate and key files.
+	Cert string
+	Key  string
+	// Insecure disables verification of broker certificate.
+	Insecure bool
+	// MaxOutbox is the maximum number of undelivered persistent messages.
+	MaxOutbox int
 }
 
 type serverConfig struct {
-	HTTP  httpConfig
-	Login loginConfig
-	Files filesConfig
-	MQTT  mqttConfig
+	HTTP       httpConfig
+	Login      loginConfig
+	Files      filesConfig
+	MQTT       mqttConfig
+	Controller controllerConfig
+	Alarm      alarmConfig
+	Sensor     sensorConfig
+	// Schedule overrides the schedules of the periodic jobs by name:
+	// sample, water, photo, rotate, push and checkpoint.
+	Schedule map[string]jobConfig
 }
 
-func main() {
-	log.Print("start")
+var defaultPlantConfig = plantConfig{
+	WaterHour:   20,
+	WaterStart:  2000,
+	MaxWater:    20000,
+	LowLevel:    1400,
+	HighLevel:   1500,
+	DailyRefill: 10,
+	LevelRange:  100,
+	UpdateHour:  9,
+	CatchUp:     3,
+}
 
+func main() {
 	var sconfFile string
 	flag.StringVar(&sconfFile, "c", "server.conf", "server config file")
 	flag.Parse()
 
-	r := raspi.NewAdaptor()
-	w, err := NewWuc(r)
-	if err != nil {
-		log.Fatalf("failed to create connection to microcontroller: %v", err)
+	if flag.Arg(0) == "backtest" {
+		runBacktest(flag.Args()[1:])
+		return
 	}
+	if flag.Arg(0) == "simulate" {
+		runSimulate(flag.Args()[1:])
+		return
+	}
+
+	log.Print("start")
 
 	pushCh := make(chan bool, 1)
 
@@ -127,48 +259,78 @@ func main() {
 			HTTP: httpConfig{
 				Addr: ":80",
 			},
+			MQTT: mqttConfig{
+				MaxOutbox: 500,
+			},
+			Alarm: alarmConfig{
+				Cooldown:    60,
+				BandHours:   6,
+				MinFreeDisk: 100,
+			},
+			Sensor: defaultSensorConfig,
 			Files: filesConfig{
 				Config:     "/var/opt/plantcare/plant.conf",
 				Data:       "/var/opt/plantcare/data.json",
 				WaterTime:  "/var/opt/plantcare/watertime.json",
+				Model:      "/var/opt/plantcare/model.json",
 				Pictures:   "/var/opt/plantcare/pics",
 				PushScript: "/opt/bin/plantcare-push-pics.sh",
+				Outbox:     "/var/opt/plantcare/outbox.json",
+
+				Calibration: "/var/opt/plantcare/calibration.json",
+
+				History:          "/var/opt/plantcare/history",
+				MinuteRetention:  14,
+				MinuteDownsample: 10,
 			},
 		},
-		Config: plantConfig{
-			WaterHour:   20,
-			WaterStart:  2000,
-			MaxWater:    20000,
-			LowLevel:    1400,
-			HighLevel:   1500,
-			DailyRefill: 10,
-			LevelRange:  100,
-			UpdateHour:  9,
-		},
-		wuc: w,
-		cam: CreatePiCam(),
+		Config:  defaultPlantConfig,
+		clock:   realClock{},
+		cam:     CreatePiCam(),
+		metrics: newMetrics(),
 		Data: measurementData{
-			Time:     time.Now().Hour(),
-			Weight:   make([]int, 0),
-			Watering: make([]int, 0),
+			Time:       time.Now().Hour(),
+			Weight:     make([]int, 0),
+			Watering:   make([]int, 0),
+			Shadow:     make([]int, 0),
+			Suppressed: make([]int, 0),
+			Times:      make([]int64, 0),
+			Quality:    make([]int, 0),
 		},
 		pushCh: pushCh,
 	}
 
 	s.parseServerConfigFile(sconfFile)
-	s.parsePlantConfigFile()
-	s.readData()
-	s.readWateringTime()
+
+	w, clk, err := newController(s.serverConfig.Controller, s.clock)
+	if err != nil {
+		log.Fatalf("failed to create connection to microcontroller: %v", err)
+	}
+	s.clock = clk
+	s.wuc = &busyController{&instrumentedController{w, s.metrics}, &s}
+
+	if s.Files.History != "" {
+		s.history, err = NewHistory(s.Files)
+		if err != nil {
+			log.Fatalf("failed to open history: %v", err)
+		}
+	}
+
+	s.readState()
 
 	if s.MQTT.Server != "" {
-		connOpts := MQTT.NewClientOptions().AddBroker(s.MQTT.Server)
-		connOpts.SetClientID(s.MQTT.ClientID)
-		connOpts.SetUsername(s.MQTT.User)
-		connOpts.SetPassword(s.MQTT.Pass)
+		connOpts := MQTT.NewClientOptions()
+		connOpts.SetOnConnectHandler(s.onMQTTConnect)
+		connOpts.SetWill(s.availabilityTopic(), "offline", 1, true)
 
-		s.mqttClient = MQTT.NewClient(connOpts)
+		s.mqtt, err = newMQTTPublisher(s.MQTT, s.Files.Outbox, connOpts)
+		if err != nil {
+			log.Fatalf("failed to create MQTT client: %v", err)
+		}
 	}
 
+	s.alerts = s.newAlertManager()
+
 	authenticator := auth.NewBasicAuthenticator("plant", s.secret())
 
 	// TODO: create own server instance and do graceful shutdown on signal
@@ -182,6 +344,14 @@ func main() {
 	http.HandleFunc("/weight", weightHandler(&s))
 	http.HandleFunc("/limit", waterLimitHandler(&s))
 	http.HandleFunc("/data", dataHandler(&s))
+	http.HandleFunc("/history", historyHandler(&s))
+	http.HandleFunc("/metrics", metricsHandler(&s))
+	http.HandleFunc("/schedule", scheduleHandler(&s))
+	http.HandleFunc("/alerts", alertsHandler(&s))
+	http.HandleFunc("/model", modelHandler(&s))
+	http.HandleFunc("/model/rollback", auth.JustCheck(authenticator, rollbackHandler(&s)))
+	http.HandleFunc("/model/reset", auth.JustCheck(authenticator, resetLearningHandler(&s)))
+	http.HandleFunc("/calibration", auth.JustCheck(authenticator, calibrationHandler(&s)))
 	http.HandleFunc("/config", auth.JustCheck(authenticator, configHandler(&s)))
 	http.HandleFunc("/echo", echoHandler(&s))
 	http.HandleFunc("/pic", auth.JustCheck(authenticator, pictureHandler(&s)))
@@ -191,7 +361,15 @@ func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	go s.run()
+	s.scheduler = s.newScheduler()
+	s.resumeWatering()
+
+	go func() {
+		if s.run() {
+			// trace replayed
+			sigs <- syscall.SIGTERM
+		}
+	}()
 
 	go func() {
 		if s.HTTP.Cert != "" {
@@ -206,17 +384,25 @@ func main() {
 		}
 	}()
 
-	go pushPictures(s.serverConfig.Files.PushScript, s.serverConfig.Files.Pictures, pushCh)
+	go pushPictures(s.serverConfig.Files.PushScript, s.serverConfig.Files.Pictures, pushCh, s.metrics, s.alerts)
 
 	<-sigs
 	log.Print("shutting down")
 
-	s.saveWateringTime()
-	s.saveData()
+	if s.mqtt != nil {
+		s.mqtt.Close(mqttMessage{
+			Topic:    s.availabilityTopic(),
+			QoS:      1,
+			Retained: true,
+			Payload:  "offline",
+		})
+	}
+
+	s.checkpoint()
 	s.mutex.Lock()
 }
 
-func pushPictures(script, folder string, ch <-chan bool) {
+func pushPictures(script, folder string, ch <-chan bool, m *metrics, a *alertManager) {
 	for <-ch {
 		log.Println("uploading pictures")
 		out, err := exec.Command(script, folder).Output()
@@ -225,14 +411,32 @@ func pushPictures(script, folder string, ch <-chan bool) {
 		}
 		switch e := err.(type) {
 		case nil:
+			m.pushRun(0)
 		case *exec.ExitError:
-			log.Println("failed to push pictures:", string(e.Stderr))
+			a.raise(alertPush, "failed to push pictures: %s", e.Stderr)
+			m.pushRun(e.ExitCode())
 		default:
-			log.Printf("failed to execute %s: %v", script, err)
+			a.raise(alertPush, "failed to execute %s: %v", script, err)
+			m.pushRun(-1)
 		}
 	}
 }
 
+// readState reads plant config, calibration, data and watering models of a
+// starting station.
+func (s *station) readState() {
+	s.parsePlantConfigFile()
+	s.readCalibration()
+	s.readData()
+	s.readWateringTime()
+	s.readModels()
+
+	// pinned model overrides watering time data saved before pinning
+	s.mutex.Lock()
+	s.applyPinnedModel()
+	s.mutex.Unlock()
+}
+
 func (s *station) parsePlantConfigFile() {
 	pc := s.serverConfig.Files.Config
 	b, err := ioutil.ReadFile(pc)
@@ -259,123 +463,304 @@ func (s *station) parseServerConfigFile(serverConf string) {
 	if err != nil {
 		log.Fatalf("failed to parse server config: %v", err)
 	}
+	s.serverConfigFile = serverConf
+}
+
+// saveServerConfig writes the server config back to the file it was read
+// from, e.g. after converting thresholds to a new calibration.
+func (s *station) saveServerConfig() error {
+	if s.serverConfigFile == "" {
+		return nil
+	}
+
+	s.mutex.RLock()
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).Encode(s.serverConfig)
+	s.mutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode server config: %v", err)
+	}
+
+	if err := writeFileAtomic(s.serverConfigFile, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to save server config to %s: %v", s.serverConfigFile, err)
+	}
+	return nil
 }
 
 func (s *station) readWateringTime() {
-	b, err := ioutil.ReadFile(s.serverConfig.Files.WaterTime)
+	err := readJSONFile(s.serverConfig.Files.WaterTime, &s.WateringTimeData)
 	if err != nil && os.IsNotExist(err) {
 		log.Printf("no old watering time data found at %s",
 			s.serverConfig.Files.WaterTime)
-		return
 	} else if err != nil {
-		log.Fatalf("failed to read watering time data to %s: %v",
+		log.Printf("failed to read watering time data from %s: %v",
 			s.serverConfig.Files.WaterTime, err)
 	}
+}
 
-	err = json.Unmarshal(b, &s.WateringTimeData)
-	if err != nil {
-		log.Fatalf("failed to marshal watering time data: %v", err)
+func (s *station) saveWateringTime() error {
+	if s.serverConfig.Files.WaterTime == "" {
+		return nil
 	}
-}
 
-func (s *station) saveWateringTime() {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	b, err := json.Marshal(s.WateringTimeData)
 	if err != nil {
-		log.Fatalf("failed to marshal watering time data: %v", err)
+		return fmt.Errorf("failed to marshal watering time data: %v", err)
 	}
 
-	err = ioutil.WriteFile(s.serverConfig.Files.WaterTime, b, 0600)
+	err = writeFileAtomic(s.serverConfig.Files.WaterTime, b, 0600)
 	if err != nil {
-		log.Fatalf("failed to save watering time data to %s: %v",
+		return fmt.Errorf("failed to save watering time data to %s: %v",
 			s.serverConfig.Files.WaterTime, err)
 	}
+
+	return nil
 }
 
 func (s *station) readData() {
-	b, err := ioutil.ReadFile(s.serverConfig.Files.Data)
+	err := readJSONFile(s.serverConfig.Files.Data, &s.Data)
 	if err != nil && os.IsNotExist(err) {
 		log.Printf("no old measurement data found at %s",
 			s.serverConfig.Files.Data)
 		return
 	} else if err != nil {
-		log.Fatalf("failed to read measurement data to %s: %v",
+		log.Printf("failed to read measurement data from %s: %v",
 			s.serverConfig.Files.Data, err)
+		return
 	}
 
-	err = json.Unmarshal(b, &s.Data)
-	if err != nil {
-		log.Fatalf("failed to marshal measurement data: %v", err)
+	if len(s.Data.Times) != len(s.Data.Weight) {
+		// data written before timestamps were stored, the last sample is
+		// the last hour matching Time before the file was written
+		last := s.clock.Now()
+		if fi, err := os.Stat(s.serverConfig.Files.Data); err == nil {
+			last = fi.ModTime()
+		}
+		last = last.Truncate(time.Hour)
+		for i := 0; i < 24 && last.Hour() != s.Data.Time; i++ {
+			last = last.Add(-time.Hour)
+		}
+		log.Printf("migrating measurement data, last sample at %v", last)
+		s.Data.migrate(last, time.Hour)
+	}
+
+	if len(s.Data.Shadow) != len(s.Data.Watering) {
+		s.Data.Shadow = make([]int, len(s.Data.Watering))
+	}
+	if len(s.Data.Suppressed) != len(s.Data.Watering) {
+		s.Data.Suppressed = make([]int, len(s.Data.Watering))
+	}
+	if len(s.Data.Reservoir) != len(s.Data.Weight) {
+		s.Data.Reservoir = make([]int, len(s.Data.Weight))
+		for i := range s.Data.Reservoir {
+			s.Data.Reservoir[i] = -1
+		}
 	}
 }
 
-func (s *station) saveData() {
+// migrate reconstructs missing timestamps and quality flags assuming
+// samples without gaps up to given time of last sample.
+func (d *measurementData) migrate(last time.Time, step time.Duration) {
+	n := len(d.Weight)
+	if len(d.Times) != n {
+		d.Times = make([]int64, n)
+		for i := range d.Times {
+			d.Times[i] = last.Add(-time.Duration(n-1-i) * step).Unix()
+		}
+	}
+	if len(d.Quality) != n {
+		d.Quality = make([]int, n)
+	}
+}
+
+// push appends a weight sample with its time and quality.
+func (d *measurementData) push(t time.Time, w, quality, maxLen int) {
+	d.Weight = pushSlice(d.Weight, w, maxLen)
+	d.Times = pushSlice64(d.Times, t.Unix(), maxLen)
+	d.Quality = pushSlice(d.Quality, quality, maxLen)
+}
+
+func (s *station) saveData() error {
+	if s.serverConfig.Files.Data == "" {
+		return nil
+	}
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	b, err := json.Marshal(s.Data)
 	if err != nil {
-		log.Fatalf("failed to marshal measurement data: %v", err)
+		return fmt.Errorf("failed to marshal measurement data: %v", err)
 	}
 
-	err = ioutil.WriteFile(s.serverConfig.Files.Data, b, 0600)
+	err = writeFileAtomic(s.serverConfig.Files.Data, b, 0600)
 	if err != nil {
-		log.Fatalf("failed to save measurement data to %s: %v",
+		return fmt.Errorf("failed to save measurement data to %s: %v",
 			s.serverConfig.Files.Data, err)
 	}
+
+	return nil
 }
 
+// checkpoint saves station state.
+func (s *station) checkpoint() {
+	if err := s.saveWateringTime(); err != nil {
+		log.Print(err)
+	}
+	if err := s.saveModels(); err != nil {
+		log.Print(err)
+	}
+	if err := s.saveData(); err != nil {
+		log.Print(err)
+	}
+}
+
+// publish queues message for MQTT broker, does nothing if MQTT is disabled.
 func (s *station) publish(topic string, qos byte, retained bool, payload string) error {
+	if s.mqtt == nil {
+		return nil
+	}
 
-	const timeout = time.Second * 10
+	return s.mqtt.Publish(mqttMessage{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  payload,
+	})
+}
 
-	if !s.mqttClient.IsConnected() {
-		log.Print("connecting to MQTT broker")
-		if token := s.mqttClient.Connect(); token.WaitTimeout(timeout) && token.Error() != nil {
-			return fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
-		}
+// publishPersistent adds message to MQTT outbox, where it is kept until
+// delivered. Does nothing if MQTT is disabled.
+func (s *station) publishPersistent(topic string, qos byte, payload string) error {
+	if s.mqtt == nil {
+		return nil
 	}
 
-	if token := s.mqttClient.Publish(topic, qos, retained, payload); token.WaitTimeout(timeout) && token.Error() != nil {
-		return fmt.Errorf("timeout while publishing: %v", token.Error())
+	return s.mqtt.PublishPersistent(mqttMessage{
+		Topic:   topic,
+		QoS:     qos,
+		Payload: payload,
+	})
+}
+
+func (s *station) onMQTTConnect(c MQTT.Client) {
+	s.subscribeCommands(c)
+
+	if err := s.publish(s.availabilityTopic(), byte(1), true, "online"); err != nil {
+		log.Printf("failed to publish availability: %v", err)
 	}
 
-	return nil
+	if s.MQTT.Discovery {
+		s.publishDiscovery()
+		s.publishState()
+	}
 }
 
-func (s *station) run() {
-	n := time.Now().Add(60 * time.Minute)
-	timer := time.NewTimer(time.Until(time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), 0, 0, 0, n.Location())))
+// run runs the periodic jobs forever, or until the end of a replayed i2c
+// trace. It returns whether a trace was replayed.
+func (s *station) run() bool {
+	r, ok := s.clock.(*ReplayConnection)
+	if !ok {
+		s.runUntil(time.Time{})
+		return false
+	}
 
-	nm := time.Now().Add(60 * time.Second)
-	mintimer := time.NewTimer(time.Until(time.Date(nm.Year(), nm.Month(), nm.Day(), nm.Hour(), nm.Minute(), 0, 0, nm.Location())))
+	if !r.Done() {
+		s.runUntil(r.End())
+	}
+	if r.Done() {
+		log.Print("i2c trace replayed")
+	} else {
+		log.Printf("i2c trace not replayed completely at %v", r.Now())
+	}
+	return true
+}
 
-	tch := timer.C
-	mtch := mintimer.C
+// runUntil runs the periodic jobs until given time, or forever if end is
+// zero.
+func (s *station) runUntil(end time.Time) {
+	s.scheduler.runUntil(end)
+}
 
-	for {
-		select {
-		case <-tch:
-			// get current hour
-			h := time.Now().Add(30 * time.Minute).Hour()
-			// next hour
-			n := time.Now().Add(90 * time.Minute)
-			log.Printf("update %v", h)
-			s.update(h)
-			// reset timer to next hour
-			timer.Reset(time.Until(time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), 0, 0, 0, n.Location())))
+// jobConfig returns the schedule of the named job, jobs not configured in
+// the server config default to the schedule of the plant config.
+func (s *station) jobConfig(name string) jobConfig {
+	if c, ok := s.serverConfig.Schedule[name]; ok {
+		return c
+	}
 
-		case <-mtch:
-			// get current hour
-			m := time.Now().Add(30 * time.Second).Minute()
-			// next hour
-			n := time.Now().Add(90 * time.Second)
-			log.Printf("minute %v", m)
-			s.updateMinute(m)
-			mintimer.Reset(time.Until(time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), n.Minute(), 0, 0, n.Location())))
+	switch name {
+	case jobSample:
+		return jobConfig{Cron: "* * * * *"}
+	case jobWater, jobCheckpoint:
+		return jobConfig{Cron: "0 * * * *"}
+	case jobPhoto, jobRotate, jobPush:
+		s.mutex.RLock()
+		h := s.Config.UpdateHour
+		s.mutex.RUnlock()
+		if h < 0 || h > 23 {
+			return jobConfig{}
 		}
+		return jobConfig{Cron: fmt.Sprintf("0 %d * * *", h), TZ: "UTC"}
+	}
+	return jobConfig{}
+}
+
+// names of the periodic jobs
+const (
+	jobSample     = "sample"
+	jobWater      = "water"
+	jobPhoto      = "photo"
+	jobRotate     = "rotate"
+	jobPush       = "push"
+	jobCheckpoint = "checkpoint"
+)
+
+func (s *station) newScheduler() *scheduler {
+	sc := newScheduler(s.clock)
+	config := func(name string) func() jobConfig {
+		return func() jobConfig { return s.jobConfig(name) }
+	}
+
+	// weight and watering are evaluated in local time
+	sc.add(jobSample, config(jobSample), func(t time.Time) {
+		s.updateMinute(t.In(time.Local))
+	})
+	sc.add(jobWater, config(jobWater), func(t time.Time) {
+		s.update(t.In(time.Local))
+	})
+	sc.add(jobPhoto, config(jobPhoto), s.takePhotoSeries)
+	sc.add(jobRotate, config(jobRotate), s.rotate)
+	sc.add(jobPush, config(jobPush), func(t time.Time) {
+		select {
+		case s.pushCh <- true:
+		default:
+			log.Print("picture push still running")
+		}
+	})
+	sc.add(jobCheckpoint, config(jobCheckpoint), func(t time.Time) {
+		s.checkpoint()
+	})
+
+	return sc
+}
+
+// resumeWatering lets the scheduler evaluate watering missed while the
+// station was down at start, missed hours before are caught up by the
+// evaluation.
+func (s *station) resumeWatering() {
+	s.mutex.RLock()
+	n := len(s.Data.Times)
+	var last time.Time
+	if n > 0 {
+		last = time.Unix(s.Data.Times[n-1], 0)
+	}
+	s.mutex.RUnlock()
+	if n > 0 {
+		s.scheduler.resume(jobWater, last)
 	}
 }
 
@@ -388,218 +773,104 @@ func pushSlice(s []int, v int, maxLen int) []int {
 	return append(s, v)
 }
 
+func pushSlice64(s []int64, v int64, maxLen int) []int64 {
+	n := len(s) + 1
+	if n > maxLen {
+		copy(s, s[n-maxLen:])
+		s = s[:maxLen-1]
+	}
+	return append(s, v)
+}
+
 func (s *station) calculateDryoutAndWateringTime() (dryout, wateringTimeScale, wateringTimeOffset int) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	dryoutSamples := make([]int, 0, len(s.Data.Weight))
-	prevw := 0
-	prevm := 0
-	numw := len(s.Data.Watering)
-	numm := len(s.Data.Weight)
-
-	// number of waterings
-	wn := float32(0)
-	// weight gain sum
-	wgsum := float32(0)
-	// squared sum of weight gain
-	wgsum2 := float32(0)
-	// watering time sum
-	wtsum := float32(0)
-	// dot product of weight gains and watering times
-	wgwtdot := float32(0)
-
-	addWatering := func(wg, wt float32) {
-		wgsum += wg
-		wtsum += wt
-		wgsum2 += wg * wg
-		wgwtdot += wt * wg
-		wn++
-	}
-
-	for i, w := range s.Data.Watering {
-		if numw-i <= numm {
-			m := s.Data.Weight[numm-numw+i]
-
-			if prevm > 0 {
-				if prevw > 0 {
-					fw := float32(prevw)
-					wg := float32(m - prevm)
-					addWatering(wg, fw)
-					//log.Printf("w: %v -> %v\n", fw, wg)
-					// wgsum += wg
-					// wtsum += fw
-					// wgsum2 += wg * wg
-					// wgwtdot += fw * wg
-					// wn++
-				} else {
-					dryoutSamples = append(dryoutSamples, prevm-m)
-				}
-			}
-			prevm = m
-		}
-		prevw = w
-	}
-
-	if s.WateringTimeData.Scale > 0 && wn > 0 {
-		// add two data points 12.5% around weightgain average calculated from previous data for stable results
-		wgavg := wgsum / wn
-		wg1 := (wgavg - wgavg/8)
-		wg2 := (wgavg + wgavg/8)
-		wt1 := wg1*float32(s.WateringTimeData.Scale) + float32(s.WateringTimeData.Offset)
-		wt2 := wg2*float32(s.WateringTimeData.Scale) + float32(s.WateringTimeData.Offset)
+	f := s.activeModel(s.fitModel())
+	return f.Dryout, f.Scale, f.Offset
+}
 
-		addWatering(wg1, wt1)
-		addWatering(wg2, wt2)
+// wateringInput returns the input of the watering strategy, must be called
+// with locked mutex.
+func (s *station) wateringInput(hour, weight int) *wateringInput {
+	// the evaluated hour is the last occurrence of hour, which is yesterday
+	// for a missed hour caught up after midnight
+	now := s.clock.Now().In(time.Local)
+	if hour > now.Hour() {
+		now = now.AddDate(0, 0, -1)
+	}
+	y, m, d := now.Date()
+
+	in := &wateringInput{
+		Hour:      hour,
+		Weight:    weight,
+		Weights:   s.Data.Weight,
+		Waterings: s.Data.Watering,
+		Times:     s.Data.Times,
+		Day:       time.Date(y, m, d, 0, 0, 0, 0, time.Local),
+		Config:    s.Config,
 	}
 
-	if len(dryoutSamples) > 0 {
-		sort.Ints(dryoutSamples)
-		n := len(dryoutSamples)
-		// we filter one upper and one lower outlier per 6 hours
-		filterBounds := n / 6
-		a := dryoutSamples[filterBounds : n-filterBounds]
-		na := len(a)
-		sum := 0
-		for _, d := range a {
-			sum += d
+	if s.Config.DryRun && len(s.Data.Shadow) == len(s.Data.Watering) {
+		// decide as if shadow waterings were done
+		in.Waterings = make([]int, len(s.Data.Watering))
+		for i, w := range s.Data.Watering {
+			if sw := s.Data.Shadow[i]; sw > w {
+				w = sw
+			}
+			in.Waterings[i] = w
 		}
-		dryout = (sum*24 + na/2) / na
-	} else {
-		log.Println("no dryout meassured")
-		dryout = 0
 	}
 
-	if wn > 0 && wgsum*wgsum < wgsum2*wn {
-		wts := (wgwtdot - wtsum*wgsum/wn) / (wgsum2 - wgsum*wgsum/wn)
-		wateringTimeOffset = int(wtsum/wn - wts*wgsum/wn)
-		wateringTimeScale = int(wts)
-	} else {
-		log.Println("cannot calculate watering times")
-		log.Printf("wn: %v\n", wn)
-		log.Printf("wgsum: %v\n", wgsum)
-		log.Printf("wgsum2: %v\n", wgsum2)
-		log.Printf("wtsum: %v\n", wtsum)
-		log.Printf("wgwtdot: %v\n", wgwtdot)
-
-		// fallback to old settings
-		wateringTimeOffset = s.WateringTimeData.Offset
-		wateringTimeScale = s.WateringTimeData.Scale
-	}
+	return in
+}
 
-	// check results
-	if wateringTimeOffset < 0 {
-		// clamp offset to zero, and calculate line through center of mass
-		log.Printf("clamping offset:  %v, %v",
-			wateringTimeScale, wateringTimeOffset)
-		wateringTimeOffset = 0
-		if wgsum > 0 {
-			wateringTimeScale = int(wtsum / wgsum)
-		}
-	} else if wateringTimeScale < 0 {
-		// set offset to half of average watering time,
-		// and calculate line through center of mass
-		log.Printf("clamping scale:  %v, %v",
-			wateringTimeScale, wateringTimeOffset)
-		if wn > 0 {
-			wateringTimeOffset = int(0.5 * wtsum / wn)
-		}
-		wateringTimeScale = int(wtsum * 0.5 / wgsum)
+// wateringStrategy returns configured watering strategy, must be called
+// with locked mutex.
+func (s *station) wateringStrategy() wateringStrategy {
+	st, err := newWateringStrategy(s.Config.Strategy)
+	if err != nil {
+		log.Printf("%v, using default", err)
+		st = adaptiveStrategy{}
 	}
-
-	return
+	return st
 }
 
-func (s *station) calculateWatering(hour int, weight int, save bool) int {
+// wateringDue reports whether watering strategy evaluates watering at given
+// hour and weight.
+func (s *station) wateringDue(hour int, weight int) bool {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	lastw := 0
-	durw := 1
+	return s.wateringStrategy().due(s.wateringInput(hour, weight))
+}
 
-	if len(s.Data.Watering) > 0 {
-		for i := len(s.Data.Watering) - 1; i >= 0; i-- {
-			durw = len(s.Data.Watering) - i
-			if s.Data.Watering[i] > 0 {
-				lastw = s.Data.Watering[i]
-				break
-			}
-		}
-	}
-	prevhi := weight
-	prevlo := weight
-	if durw > 1 && len(s.Data.Weight) >= durw {
-		prevlo = s.Data.Weight[len(s.Data.Weight)-durw]
-		prevhi = s.Data.Weight[len(s.Data.Weight)-durw+1]
+func (s *station) calculateWatering(hour int, weight int, save bool) int {
+	if save {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	} else {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
 	}
 
-	log.Printf("last watered %v hours ago, watered %vs, last weights: %v, %v",
-		durw, lastw, prevlo, prevhi)
-
-	// dl := float32(s.Config.DstLevel - avg)
-	// rl := float32(s.Config.LevelRange)
-	// rw := float32(s.Config.MaxWater - s.Config.WaterStart)
-	// dw := dl / rl * rw
-
-	// log.Printf("adjusting watering time by %v", dw)
-
-	// wt := lastw + int(dw+0.5)
-
 	// dryout per 24h, watering time scale, water time offset
+	f := s.fitModel()
+	m := s.activeModel(f)
+	dryout, wts, wto := m.Dryout, m.Scale, m.Offset
 
-	dryout, wts, wto := s.calculateDryoutAndWateringTime()
-
-	wtime := func(dw int) int {
-		return wts*dw + wto
-	}
-
-	dw := 0
-	wt := 0
-	minLevel := s.Config.LowLevel + dryout*23/24
-
-	if weight <= s.Config.LowLevel {
-		// full refill
-		dw = s.Config.HighLevel - weight
-		wt = wtime(dw)
-		log.Printf("full refill")
-	} else if weight < minLevel {
-		dwhi := s.Config.HighLevel - weight
-		dwlo := minLevel - weight
-		hiwt := wtime(dwhi)
-		lowt := wtime(dwlo)
-		// clamp to high level
-		if minLevel > s.Config.HighLevel {
-			log.Print("clamping refill to high level")
-			dw = dwhi
-			wt = hiwt
-		} else if prevlo < minLevel && prevhi < (s.Config.HighLevel+minLevel)/2 {
-			// Previous low level was already in range for minimum refill,
-			// and previous high level was nearer to minimum refill level
-			// than to full refill.
-			log.Print("refill to high level")
-			dw = dwhi
-			wt = hiwt
-		} else {
-			log.Print("minimum refill")
-			dw = dwlo
-			wt = lowt
-		}
-	} else if s.Config.DailyRefill > 0 {
-		dw = prevhi - dryout*durw/24 + s.Config.DailyRefill - weight
-		// clamp to previous weight
-		if dw > prevhi-weight {
-			dw = prevhi - weight
-		}
-		wt = wtime(dw)
-		log.Print("daily refill")
-	}
+	p := s.wateringStrategy().plan(s.wateringInput(hour, weight), wateringModel{
+		Dryout: dryout,
+		Scale:  wts,
+		Offset: wto,
+	})
+	wt := p.Time
 
 	if save {
-		s.WateringTimeData.Offset = wto
-		s.WateringTimeData.Scale = wts
+		s.applyFit(f)
 	}
 
-	log.Printf("dryout: %v, wt scale: %v, wt offset: %v, delta weight: %v", dryout, wts, wto, dw)
+	log.Printf("dryout: %v, wt scale: %v, wt offset: %v, delta weight: %v", dryout, wts, wto, p.Delta)
 	log.Printf("watering time: %v", wt)
 
 	if wt <= 0 {
@@ -618,7 +889,10 @@ func clamp(v, min, max int) int {
 	return v
 }
 
-func hourMedian(mindata []int) int {
+// hourMedian returns the median weight of the last hour of minute samples.
+// Rejected, fallback and interpolated samples are only used if there is no
+// measured sample.
+func hourMedian(mindata, quality []int) int {
 	i0 := 0
 	n := len(mindata)
 
@@ -629,91 +903,314 @@ func hourMedian(mindata []int) int {
 	if n > 60 {
 		i0 = n - 60
 	}
-	d := make([]int, n-i0)
-	copy(d, mindata[i0:])
+	d := make([]int, 0, n-i0)
+	for i := i0; i < n; i++ {
+		if i < len(quality) && quality[i] == qualityMeasured {
+			d = append(d, mindata[i])
+		}
+	}
+	if len(d) == 0 {
+		d = append(d, mindata[i0:]...)
+	}
 	sort.Ints(d)
 	return d[len(d)/2]
 }
 
-func (s *station) updateWeightAndWatering(hour int) {
+// hasQuality reports whether the last hour of quality flags contains a
+// sample of quality q.
+func hasQuality(quality []int, q int) bool {
+	i0 := len(quality) - 60
+	if i0 < 0 {
+		i0 = 0
+	}
+	for _, v := range quality[i0:] {
+		if v == q {
+			return true
+		}
+	}
+	return false
+}
+
+// wateringHour is an hour watering is evaluated for.
+type wateringHour struct {
+	hour int
+	// catchUp is set for a missed hour evaluated late.
+	catchUp bool
+}
+
+// wateringHours returns the local hours watering is evaluated for at the
+// update of hour t, current hour first. A DST transition repeats an hour,
+// which is evaluated only once, or skips an hour, which is evaluated with
+// the following one. Hours missed since the last update, e.g. by a reboot
+// or clock jump, are caught up within the CatchUp grace period unless
+// watered since. After the clock jumped back no hour is evaluated again.
+func (s *station) wateringHours(t time.Time) []wateringHour {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	h := t.Hour()
+	n := len(s.Data.Times)
+	if n == 0 {
+		return []wateringHour{{hour: h}}
+	}
+
+	prev := time.Unix(s.Data.Times[n-1], 0).In(t.Location())
+	if !t.After(prev) {
+		log.Printf("clock jumped back to %v, hour %v already evaluated", t, h)
+		return nil
+	}
+	if t.Sub(prev) <= 90*time.Minute {
+		switch (h - prev.Hour() + 24) % 24 {
+		case 0:
+			log.Printf("hour %v repeated", h)
+			return nil
+		case 2:
+			log.Printf("hour %v skipped", (h+23)%24)
+			return []wateringHour{{hour: h}, {hour: (h + 23) % 24}}
+		}
+		return []wateringHour{{hour: h}}
+	}
+
+	hours := []wateringHour{{hour: h}}
+	grace := time.Duration(s.Config.CatchUp) * time.Hour
+	for m := truncateHour(prev).Add(time.Hour); m.Before(t); m = m.Add(time.Hour) {
+		if t.Sub(m) > grace {
+			continue
+		}
+		if s.wateredSince(m) {
+			log.Printf("missed hour %v already watered", m.Hour())
+			continue
+		}
+		log.Printf("catching up missed hour %v", m.Hour())
+		hours = append(hours, wateringHour{hour: m.Hour(), catchUp: true})
+	}
+	return hours
+}
+
+// wateredSince reports whether a watering was recorded since given time,
+// including shadow and suppressed waterings, as their hours were handled.
+// Must be called with locked mutex. The history is checked as well, as it
+// is written before the data is saved.
+func (s *station) wateredSince(from time.Time) bool {
+	for i, ts := range s.Data.Times {
+		if ts < from.Unix() || i >= len(s.Data.Watering) {
+			continue
+		}
+		if s.Data.Watering[i] > 0 || i < len(s.Data.Shadow) && s.Data.Shadow[i] > 0 ||
+			i < len(s.Data.Suppressed) && s.Data.Suppressed[i] > 0 {
+			return true
+		}
+	}
+
+	if s.history != nil {
+		samples, err := s.history.Read(historyHour, from, s.clock.Now())
+		if err != nil {
+			log.Printf("failed to read history: %v", err)
+			// rather skip than double water
+			return true
+		}
+		for _, smp := range samples {
+			if smp.Watering > 0 || smp.Shadow > 0 || smp.Suppressed > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *station) updateWeightAndWatering(t time.Time) {
+	hour := t.Hour()
 	var err error
 	var w int
+	q := qualityMeasured
 
+	raw := 0
 	if len(s.MinData.Weight) == 0 {
-		w, err = s.wuc.ReadWeight()
+		w, raw, err = s.readWeight()
 		if err != nil {
 			log.Printf("failed to read weight: %v", err)
+			q = qualityFallback
 
 			// fallback to last read weight
 			n := len(s.Data.Weight)
 			if n > 0 {
 				w = s.Data.Weight[n-1]
 			}
+		} else {
+			s.mutex.RLock()
+			if s.busyAt(s.clock.Now()) {
+				q = qualityBusy
+			}
+			s.mutex.RUnlock()
 		}
 	} else {
-		w = hourMedian(s.MinData.Weight)
+		s.mutex.RLock()
+		w = hourMedian(s.MinData.Weight, s.MinData.Quality)
+		if !hasQuality(s.MinData.Quality, qualityMeasured) {
+			q = qualityFallback
+		}
+		s.mutex.RUnlock()
 	}
 
+	s.mutex.RLock()
+	cal := s.Calibration.Time
+	// pot emptied or loaded with reference weights during the hour
+	calibrating := s.calibrationSession != nil || hasQuality(s.MinData.Quality, qualityCalibrating)
+	s.mutex.RUnlock()
+	if calibrating {
+		q = qualityCalibrating
+	}
+
+	level := s.readReservoir()
+
 	// calculate watering time
 	wt := 0
-	if hour == s.Config.WaterHour {
-		wt = s.calculateWatering(hour, w, true)
+	catchUp := false
+	for _, h := range s.wateringHours(t) {
+		if s.wateringDue(h.hour, w) {
+			wt = s.calculateWatering(h.hour, w, true)
+			catchUp = h.catchUp && wt > 0
+			break
+		}
 	}
-	if wt > 0 {
+	if catchUp {
+		log.Printf("catch-up watering of %v ms", wt)
+	}
+	shadow := 0
+	suppressed := 0
+	if wt > 0 && s.Config.DryRun {
+		log.Printf("dry run, skipping watering of %v ms", wt)
+		shadow = wt
+		wt = 0
+		if err := s.publishPersistent(s.MQTT.Topic+"/shadow", byte(2), fmt.Sprint(shadow)); err != nil {
+			log.Printf("failed to publish shadow watering: %v", err)
+		}
+	} else if wt > 0 && calibrating {
+		log.Printf("calibration in progress, skipping watering of %v ms", wt)
+		suppressed = wt
+		wt = 0
+	} else if wt > 0 && s.sensorFailed() {
+		log.Printf("weight sensor failed, skipping watering of %v ms", wt)
+		suppressed = wt
+		wt = 0
+	} else if wt > 0 && s.reservoirEmpty(level) {
+		log.Printf("reservoir below safe level, skipping watering of %v ms", wt)
+		suppressed = wt
+		wt = 0
+	} else if wt > 0 {
+		req := wt
 		wt = s.wuc.DoWatering(s.WateringTimeData.Offset, wt)
-		s.publish(s.MQTT.Topic+"/water", byte(2), false, fmt.Sprint(wt))
+		if wt == 0 {
+			s.alerts.raise(alertWatering, "watering of %v ms failed", req)
+		}
+		if err := s.publishPersistent(s.MQTT.Topic+"/water", byte(2), fmt.Sprint(wt)); err != nil {
+			log.Printf("failed to publish watering: %v", err)
+		}
 	} else {
 		wt = 0
 	}
 
+	if s.history != nil {
+		if err := s.history.AddHour(historySample{
+			Time:       t.Unix(),
+			Weight:     w,
+			Raw:        raw,
+			Watering:   wt,
+			Shadow:     shadow,
+			Suppressed: suppressed,
+			Quality:    q,
+			CatchUp:    catchUp,
+			Cal:        cal,
+			Reservoir: func() *int {
+				if level < 0 {
+					return nil
+				}
+				return &level
+			}(),
+		}); err != nil {
+			log.Printf("failed to add hour to history: %v", err)
+		}
+	}
+
 	// update values
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if n := len(s.Data.Weight); n > 0 && n == len(s.Data.Watering) {
+		if lw := s.Data.Watering[n-1]; lw > 0 && w <= s.Data.Weight[n-1] {
+			s.alerts.raise(alertWatering, "no weight gain after watering of %v ms", lw)
+		}
+	}
+
 	s.Data.Time = hour
 	const maxHours = backlogDays * 24
-	s.Data.Weight = pushSlice(s.Data.Weight, w, maxHours)
+	s.Data.push(t, w, q, maxHours)
 	s.Data.Watering = pushSlice(s.Data.Watering, wt, maxHours)
+	s.Data.Shadow = pushSlice(s.Data.Shadow, shadow, maxHours)
+	s.Data.Suppressed = pushSlice(s.Data.Suppressed, suppressed, maxHours)
+	s.Data.Reservoir = pushSlice(s.Data.Reservoir, level, maxHours)
+	if catchUp {
+		s.Data.CatchUp = append(s.Data.CatchUp, t.Unix())
+	}
+	// drop catch-ups older than the oldest sample
+	for len(s.Data.CatchUp) > 0 && s.Data.CatchUp[0] < s.Data.Times[0] {
+		s.Data.CatchUp = s.Data.CatchUp[1:]
+	}
+
+	s.checkBand()
 }
 
-func (s *station) update(hour int) {
-	s.updateWeightAndWatering(hour)
+// update runs the hourly update of hour t in local time.
+func (s *station) update(t time.Time) {
+	s.updateWeightAndWatering(t)
+	s.updateReservoir()
+	s.checkDisk()
 
-	now := time.Now()
-	utc := now.UTC()
+	if s.history != nil {
+		if err := s.history.Compact(s.clock.Now()); err != nil {
+			log.Printf("failed to compact history: %v", err)
+		}
+	}
 
-	if utc.Hour() == s.Config.UpdateHour {
-		// calculate angle for picture
-		day := utc.Unix() / (24 * 60 * 60)
-		angle := uint64(day)
+	s.publishState()
+}
 
-		timestr := now.Format("2006-01-02")
-		s.takePictures(angle, fmt.Sprintf("image-%s", timestr))
-		s.takePictures(angle+120, fmt.Sprintf("image-b-%s", timestr))
-		s.takePictures(angle+240, fmt.Sprintf("image-c-%s", timestr))
+// takePhotoSeries takes pictures from three sides, starting at an angle
+// advancing by a degree per day.
+func (s *station) takePhotoSeries(t time.Time) {
+	defer s.actuatorBusy()()
 
-		s.pushCh <- true
+	day := t.Unix() / (24 * 60 * 60)
+	angle := uint64(day)
 
-		// os.Chdir(s.serverConfig.Files.Pictures)
-		// exec.Command("drive", "push", "-files", "-no-prompt", "-no-clobber", "plant")
+	timestr := t.In(time.Local).Format("2006-01-02")
+	s.takePictures(angle, fmt.Sprintf("image-%s", timestr))
+	s.takePictures(angle+120, fmt.Sprintf("image-b-%s", timestr))
+	s.takePictures(angle+240, fmt.Sprintf("image-c-%s", timestr))
+}
 
-		if s.Config.FixedOrientation != nil {
-			angle = uint64(*s.Config.FixedOrientation)
-			log.Printf("fixed orientation: %v", angle)
-		} else {
-			angle = uint64(day * 190)
-			log.Printf("day: %v, angle: %v", day, angle)
-		}
-		err := s.wuc.Rotate(angle)
-		if err != nil {
-			log.Println("failed to rotate plant: ", err)
-		}
+// rotate turns the plant to the fixed orientation or by 190° per day.
+func (s *station) rotate(t time.Time) {
+	day := t.Unix() / (24 * 60 * 60)
+
+	var angle uint64
+	if s.Config.FixedOrientation != nil {
+		angle = uint64(*s.Config.FixedOrientation)
+		log.Printf("fixed orientation: %v", angle)
+	} else {
+		angle = uint64(day * 190)
+		log.Printf("day: %v, angle: %v", day, angle)
+	}
+	err := s.wuc.Rotate(angle)
+	if err != nil {
+		s.alerts.raise(alertRotation, "failed to rotate plant: %v", err)
 	}
 }
 
 func (s *station) takePictures(angle uint64, fileBaseName string) {
 	err := s.wuc.Rotate(angle)
 	if err != nil {
-		log.Println("failed to rotate plant: ", err)
+		s.alerts.raise(alertRotation, "failed to rotate plant: %v", err)
 		return
 	}
 
@@ -721,7 +1218,8 @@ func (s *station) takePictures(angle uint64, fileBaseName string) {
 	for i, ev := range evs {
 		file, err := s.cam.TakePicture(s.serverConfig.Files.Pictures, ev, 0)
 		if err != nil {
-			log.Println("failed to take picture:", err)
+			s.alerts.raise(alertCamera, "failed to take picture: %v", err)
+			s.metrics.cameraFailure()
 			if file != "" {
 				os.Remove(file)
 			}
@@ -743,35 +1241,79 @@ func (s *station) takePictures(angle uint64, fileBaseName string) {
 	}
 }
 
-func (s *station) updateMinute(min int) {
-	w, err := s.wuc.ReadWeight()
+func (s *station) updateMinute(t time.Time) {
+	q := qualityMeasured
+
+	s.mutex.RLock()
+	busy := s.busyAt(s.clock.Now())
+	s.mutex.RUnlock()
+
+	w, raw, err := s.readWeight()
+	measured := w
+
+	// update values
+	s.mutex.Lock()
+	cal := s.Calibration.Time
+	busy = busy || s.busyAt(s.clock.Now())
+
+	changed := s.updateSensorHealth(raw, err)
 	if err != nil {
 		log.Printf("failed to read weight: %v", err)
+		q = qualityFallback
 		// fallback to last read weight
 		n := len(s.MinData.Weight)
 		if n > 0 {
 			w = s.MinData.Weight[n-1]
 		}
+	} else if s.calibrationSession != nil {
+		// pot emptied or loaded with reference weights
+		q = qualityCalibrating
+	} else if busy {
+		log.Printf("actuator busy, flagging weight %v", w)
+		q = qualityBusy
+	} else {
+		w, q = s.filterWeight(w)
 	}
 
-	// update values
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	// minutes since last measuring
-	numMins := (min - s.MinData.Time + 60) % 60
-	if len(s.MinData.Weight) == 0 {
-		// no data yet, its first measuring, set to 1
+	numMins := 1
+	n := len(s.MinData.Times)
+	if n > 0 {
+		numMins = int(t.Sub(time.Unix(s.MinData.Times[n-1], 0)) / time.Minute)
+	}
+	if numMins < 1 {
 		numMins = 1
+	} else if numMins > backlogMinutes {
+		numMins = backlogMinutes
 	}
 
-	s.MinData.Time = min
+	s.MinData.Time = t.Minute()
 	if numMins != 1 {
 		log.Printf("missed %v minutes", numMins-1)
 	}
 
-	for i := 0; i < numMins; i++ {
-		s.MinData.Weight = pushSlice(s.MinData.Weight, w, backlogMinutes)
+	// interpolate linearly from last sample
+	w0 := w
+	if n > 0 && n == len(s.MinData.Weight) {
+		w0 = s.MinData.Weight[n-1]
+	}
+	for i := 1; i < numMins; i++ {
+		mt := t.Add(-time.Duration(numMins-i) * time.Minute)
+		iw := w0 + (w-w0)*i/numMins
+		s.MinData.push(mt, iw, qualityInterpolated, backlogMinutes)
+	}
+	s.MinData.push(t, w, q, backlogMinutes)
+	s.mutex.Unlock()
+
+	if err == nil && s.history != nil {
+		// history keeps the reading, flagged if rejected
+		if err := s.history.AddMinute(t, measured, raw, q, cal); err != nil {
+			log.Printf("failed to add minute to history: %v", err)
+		}
+	}
+
+	if changed {
+		s.sensorHealthChanged()
 	}
 
 	s.publish(s.MQTT.Topic+"/weight", byte(0), true, fmt.Sprint(w))
@@ -794,6 +1336,60 @@ func dataHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func historyHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.history == nil {
+			http.Error(w, "history disabled", http.StatusNotFound)
+			return
+		}
+
+		res := historyHour
+		if args, ok := r.URL.Query()["res"]; ok && len(args) > 0 {
+			res = args[0]
+		}
+		if res != historyHour && res != historyMinute {
+			http.Error(w, "invalid resolution", http.StatusBadRequest)
+			return
+		}
+
+		to := s.clock.Now()
+		from := to.AddDate(0, 0, -30)
+
+		parseTime := func(name string, t *time.Time) bool {
+			args, ok := r.URL.Query()[name]
+			if !ok || len(args) < 1 {
+				return true
+			}
+			v, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid argument: %v", err), http.StatusBadRequest)
+				return false
+			}
+			*t = time.Unix(v, 0)
+			return true
+		}
+
+		if !parseTime("from", &from) || !parseTime("to", &to) {
+			return
+		}
+
+		samples, err := s.history.Read(res, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		js, err := json.Marshal(samples)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
+
 func checkAuth(user, pass string) bool {
 	return user == "user" && pass == "pass"
 }
@@ -818,29 +1414,92 @@ func (s *station) saveConfig(w http.ResponseWriter, r io.Reader) {
 		return
 	}
 
-	c := s.Config
-	err = json.Unmarshal(b, &c)
-	if err != nil {
+	err = s.updateConfig(b)
+	if _, ok := err.(configError); ok {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err)
 		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	fmt.Fprint(w, "config saved")
+}
+
+// configError is returned by updateConfig for invalid config.
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string {
+	return fmt.Sprintf("invalid config: %v", e.err)
+}
+
+// updateConfig merges given JSON encoded config into plant config and
+// saves it.
+func (s *station) updateConfig(b []byte) error {
+	s.mutex.RLock()
+	c := s.Config
+	s.mutex.RUnlock()
+
+	// decode into a copy of pinned model, not the current one
+	if c.Model != nil {
+		m := *c.Model
+		c.Model = &m
+	}
+
+	err := json.Unmarshal(b, &c)
+	if err != nil {
+		return configError{err}
+	}
+
+	if _, err := newWateringStrategy(c.Strategy); err != nil {
+		return configError{err}
+	}
+
+	hours := make(map[int]bool)
+	for _, w := range c.Windows {
+		if w.Hour < 0 || w.Hour > 23 || hours[w.Hour] {
+			return configError{fmt.Errorf("invalid watering window hour: %v", w.Hour)}
+		}
+		if w.Share < 0 || w.Refill < 0 || w.Share == 0 && w.Refill == 0 {
+			return configError{fmt.Errorf("invalid share of watering window at %v", w.Hour)}
+		}
+		hours[w.Hour] = true
+	}
+	sort.Slice(c.Windows, func(i, j int) bool {
+		return c.Windows[i].Hour < c.Windows[j].Hour
+	})
+
+	if m := c.Model; m != nil {
+		if m.Scale <= 0 || m.Offset < 0 {
+			return configError{fmt.Errorf("invalid watering model: scale %v, offset %v", m.Scale, m.Offset)}
+		}
+		m.Since = 0
 	}
 
 	b, err = json.Marshal(c)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
-		return
+		return err
 	}
 
-	err = ioutil.WriteFile(s.serverConfig.Files.Config, b, 0600)
+	err = writeFileAtomic(s.serverConfig.Files.Config, b, 0600)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
+		return err
 	}
 
+	s.mutex.Lock()
+	pinned := c.Model != nil && (s.Config.Model == nil || *s.Config.Model != *c.Model)
 	s.Config = c
-	fmt.Fprint(w, "config saved")
+	s.applyPinnedModel()
+	s.mutex.Unlock()
+
+	if pinned {
+		return s.saveWateringTime()
+	}
+	return nil
 }
 
 func (s *station) sendConfig(w http.ResponseWriter) {
@@ -882,6 +1541,7 @@ func pictureHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 
 		filename, err := s.cam.TakePicture("", ev, uint(shrink))
 		if err != nil {
+			s.metrics.cameraFailure()
 			fmt.Fprint(w, "failed to take picture: ", err)
 			return
 		}
@@ -965,13 +1625,16 @@ func wateringHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 
 func weightHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		we, err := s.wuc.ReadWeight()
+		we, raw, err := s.readWeight()
 		if err != nil {
 			log.Println("failed to read weight: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err)
 			return
 		}
+		if _, ok := r.URL.Query()["raw"]; ok {
+			we = raw
+		}
 		fmt.Fprintf(w, "%v", we)
 	}
 }
@@ -995,9 +1658,9 @@ func calcWateringHandler(s *station) func(w http.ResponseWriter, r *http.Request
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 
-		dryout, wts, wto := s.calculateDryoutAndWateringTime()
+		f := s.activeModel(s.fitModel())
 
-		fmt.Fprintf(w, "%v %v %v", dryout, wts, wto)
+		fmt.Fprintf(w, "%v %v %v", f.Dryout, f.Scale, f.Offset)
 	}
 }
 
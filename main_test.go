@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+	return loc
+}
+
+// setLocal sets the local time zone of the station for the duration of a
+// test.
+func setLocal(t *testing.T, loc *time.Location) {
+	old := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = old })
+}
+
+// stubController returns a fixed weight reading.
+type stubController struct {
+	Controller
+
+	mutex  sync.Mutex
+	weight int
+	err    error
+}
+
+func (c *stubController) ReadWeight() (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.weight, c.err
+}
+
+// rotationRecorder records the times of rotations.
+type rotationRecorder struct {
+	Controller
+	clock clock
+
+	mutex     sync.Mutex
+	rotations []time.Time
+}
+
+func (c *rotationRecorder) Rotate(angle uint64) error {
+	c.mutex.Lock()
+	c.rotations = append(c.rotations, c.clock.Now())
+	c.mutex.Unlock()
+	return c.Controller.Rotate(angle)
+}
+
+func TestTruncateHour(t *testing.T) {
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+	kathmandu := mustLoadLocation(t, "Asia/Kathmandu")
+
+	tests := []struct {
+		in, want time.Time
+	}{
+		{
+			time.Date(2020, 1, 1, 10, 47, 12, 5, time.UTC),
+			time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			time.Date(2020, 1, 1, 10, 47, 0, 0, kolkata),
+			time.Date(2020, 1, 1, 10, 0, 0, 0, kolkata),
+		},
+		{
+			time.Date(2020, 1, 1, 10, 20, 0, 0, kathmandu),
+			time.Date(2020, 1, 1, 10, 0, 0, 0, kathmandu),
+		},
+	}
+	for _, tt := range tests {
+		if got := truncateHour(tt.in); !got.Equal(tt.want) {
+			t.Errorf("truncateHour(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateMinuteMissed(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clk := newFakeClock(start)
+	s := &station{clock: clk, Config: defaultPlantConfig}
+	c := &stubController{weight: 1000}
+	s.wuc = c
+
+	s.updateMinute(start)
+	c.weight = 1040
+	s.updateMinute(start.Add(4 * time.Minute))
+
+	d := s.MinData
+	wantTimes := []int64{0, 60, 120, 180, 240}
+	wantWeight := []int{1000, 1010, 1020, 1030, 1040}
+	wantQuality := []int{qualityMeasured, qualityInterpolated, qualityInterpolated, qualityInterpolated, qualityMeasured}
+	if len(d.Times) != len(wantTimes) {
+		t.Fatalf("got %d samples, want %d", len(d.Times), len(wantTimes))
+	}
+	for i := range wantTimes {
+		d.Times[i] -= start.Unix()
+	}
+	if !reflect.DeepEqual(d.Times, wantTimes) {
+		t.Errorf("times %v, want %v", d.Times, wantTimes)
+	}
+	if !reflect.DeepEqual(d.Weight, wantWeight) {
+		t.Errorf("weights %v, want %v", d.Weight, wantWeight)
+	}
+	if !reflect.DeepEqual(d.Quality, wantQuality) {
+		t.Errorf("quality %v, want %v", d.Quality, wantQuality)
+	}
+}
+
+func TestWateringHours(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	utc := func(h int) time.Time {
+		return time.Date(2020, 6, 1, h, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		// times of recorded samples
+		times []time.Time
+		// waterings of recorded samples, none if nil
+		watering []int
+		catchUp  int
+		t        time.Time
+		want     []wateringHour
+	}{
+		{
+			name: "first update",
+			t:    utc(10),
+			want: []wateringHour{{hour: 10}},
+		},
+		{
+			name:  "next hour",
+			times: []time.Time{utc(9)},
+			t:     utc(10),
+			want:  []wateringHour{{hour: 10}},
+		},
+		{
+			name:  "repeated hour",
+			times: []time.Time{time.Date(2020, 10, 25, 0, 0, 0, 0, time.UTC).In(berlin)},
+			// 02:00 CET after 02:00 CEST
+			t:    time.Date(2020, 10, 25, 1, 0, 0, 0, time.UTC).In(berlin),
+			want: nil,
+		},
+		{
+			name:  "skipped hour",
+			times: []time.Time{time.Date(2020, 3, 29, 0, 0, 0, 0, time.UTC).In(berlin)},
+			// 03:00 CEST after 01:00 CET
+			t:    time.Date(2020, 3, 29, 1, 0, 0, 0, time.UTC).In(berlin),
+			want: []wateringHour{{hour: 3}, {hour: 2}},
+		},
+		{
+			name:  "clock jumped back",
+			times: []time.Time{utc(11)},
+			t:     utc(10),
+			want:  nil,
+		},
+		{
+			name:  "same hour again",
+			times: []time.Time{utc(10)},
+			t:     utc(10),
+			want:  nil,
+		},
+		{
+			name:    "missed hours within grace",
+			times:   []time.Time{utc(10)},
+			catchUp: 3,
+			t:       utc(14),
+			want: []wateringHour{
+				{hour: 14},
+				{hour: 11, catchUp: true},
+				{hour: 12, catchUp: true},
+				{hour: 13, catchUp: true},
+			},
+		},
+		{
+			name:    "missed hours beyond grace",
+			times:   []time.Time{utc(10)},
+			catchUp: 1,
+			t:       utc(14),
+			want:    []wateringHour{{hour: 14}, {hour: 13, catchUp: true}},
+		},
+		{
+			name:    "missed hours without catch-up",
+			times:   []time.Time{utc(10)},
+			catchUp: 0,
+			t:       utc(14),
+			want:    []wateringHour{{hour: 14}},
+		},
+		{
+			name:     "missed hours already watered",
+			times:    []time.Time{utc(10), utc(12)},
+			watering: []int{0, 5000},
+			catchUp:  3,
+			t:        utc(15),
+			want:     []wateringHour{{hour: 15}, {hour: 13, catchUp: true}, {hour: 14, catchUp: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &station{clock: newFakeClock(tt.t), Config: defaultPlantConfig}
+			s.Config.CatchUp = tt.catchUp
+			for i, ts := range tt.times {
+				s.Data.push(ts, 1000, qualityMeasured, 100)
+				w := 0
+				if tt.watering != nil {
+					w = tt.watering[i]
+				}
+				s.Data.Watering = append(s.Data.Watering, w)
+			}
+
+			got := s.wateringHours(tt.t)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wateringHours(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestStation returns a simulated station recording rotations.
+func newTestStation(c plantConfig, start time.Time) (*station, *SimWuc, *rotationRecorder) {
+	s, sim := newSimStation(c, simConfig{
+		Weight:    (c.LowLevel + c.HighLevel) / 2,
+		Reservoir: 1000000,
+		Noise:     1,
+		Seed:      1,
+	}, start)
+	s.WateringTimeData.Scale = 100
+	rec := &rotationRecorder{Controller: s.wuc, clock: s.clock}
+	s.wuc = rec
+	return s, sim, rec
+}
+
+func TestRunUntilDST(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	setLocal(t, berlin)
+
+	tests := []struct {
+		name  string
+		day   time.Time
+		hours int
+	}{
+		{"spring forward", time.Date(2020, 3, 29, 0, 0, 0, 0, berlin), 23},
+		{"fall back", time.Date(2020, 10, 25, 0, 0, 0, 0, berlin), 25},
+		{"regular day", time.Date(2020, 6, 1, 0, 0, 0, 0, berlin), 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultPlantConfig
+			c.WaterHour = 2
+			s, _, _ := newTestStation(c, tt.day.AddDate(0, 0, -1))
+			s.runUntil(tt.day.AddDate(0, 0, 1))
+
+			n := 0
+			for i, ts := range s.Data.Times {
+				if i > 0 && ts-s.Data.Times[i-1] != 3600 {
+					t.Errorf("samples %v and %v not an hour apart",
+						time.Unix(s.Data.Times[i-1], 0), time.Unix(ts, 0))
+				}
+				y, m, d := time.Unix(ts, 0).Date()
+				if y == tt.day.Year() && m == tt.day.Month() && d == tt.day.Day() {
+					n++
+				}
+			}
+			if n != tt.hours {
+				t.Errorf("got %d hourly samples on %v, want %d", n, tt.day.Format("2006-01-02"), tt.hours)
+			}
+		})
+	}
+}
+
+func TestUpdateHourUTCWaterHourLocal(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	setLocal(t, berlin)
+
+	c := defaultPlantConfig
+	c.WaterHour = 20
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, berlin)
+	s, sim, rec := newTestStation(c, start)
+	// pot dry, watered at first watering hour
+	sim.weight = float64(c.LowLevel - 100)
+	// photos and rotation at UpdateHour in UTC, camera failing
+	s.Config.UpdateHour = 9
+	s.cam = &PiCam{exe: "/nonexistent", mutex: &sync.Mutex{}}
+	s.serverConfig.Files.Pictures = t.TempDir()
+	s.pushCh = make(chan bool, 1)
+
+	s.runUntil(start.AddDate(0, 0, 1))
+
+	// three photo positions and the rotation of the day
+	if len(rec.rotations) != 4 {
+		t.Fatalf("rotated %d times, want 4", len(rec.rotations))
+	}
+	for _, r := range rec.rotations {
+		if r.UTC().Hour() != 9 || r.In(berlin).Hour() != 10 {
+			t.Errorf("rotated at %v, want 9:00 UTC", r)
+		}
+	}
+
+	var watered []time.Time
+	for i, w := range s.Data.Watering {
+		if w > 0 {
+			watered = append(watered, time.Unix(s.Data.Times[i], 0))
+		}
+	}
+	if len(watered) != 1 {
+		t.Fatalf("watered at %v, want once", watered)
+	}
+	if w := watered[0]; w.In(berlin).Hour() != 20 || w.UTC().Hour() != 19 {
+		t.Errorf("watered at %v, want 20:00 local", w.In(berlin))
+	}
+}
+
+func TestRunUntilResumesWatering(t *testing.T) {
+	setLocal(t, time.UTC)
+
+	tests := []struct {
+		name string
+		// time of last hourly sample
+		last time.Time
+		// hourly samples recorded until 20:45
+		want []time.Time
+	}{
+		{
+			name: "missed water hour",
+			last: time.Date(2020, 1, 1, 17, 0, 0, 0, time.UTC),
+			want: []time.Time{time.Date(2020, 1, 1, 20, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "nothing missed",
+			last: time.Date(2020, 1, 1, 20, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultPlantConfig
+			start := time.Date(2020, 1, 1, 20, 30, 0, 0, time.UTC)
+			s, sim, _ := newTestStation(c, start)
+			// pot dry, watering due at WaterHour
+			sim.weight = float64(c.LowLevel - 100)
+			s.Data.push(tt.last, c.LowLevel-100, qualityMeasured, 10)
+			s.Data.Watering = []int{0}
+			s.resumeWatering()
+
+			s.runUntil(start.Add(15 * time.Minute))
+
+			var got []time.Time
+			for i, ts := range s.Data.Times[1:] {
+				got = append(got, time.Unix(ts, 0).UTC())
+				if s.Data.Watering[i+1] == 0 {
+					t.Errorf("not watered at %v", time.Unix(ts, 0))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hourly samples at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuppressedWatering(t *testing.T) {
+	setLocal(t, time.UTC)
+
+	tests := []struct {
+		name  string
+		setup func(s *station, sim *SimWuc)
+	}{
+		{"reservoir empty", func(s *station, sim *SimWuc) {
+			s.Config.ReservoirSafe = sim.Reservoir() + 1
+		}},
+		{"sensor dead", func(s *station, sim *SimWuc) {
+			s.serverConfig.Sensor.FailMinutes = 5
+			sim.config.FailureRate = 1
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultPlantConfig
+			start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			s, sim, _ := newTestStation(c, start)
+			// pot dry, watering due at WaterHour
+			sim.weight = float64(c.LowLevel - 100)
+			tt.setup(s, sim)
+
+			s.runUntil(start.AddDate(0, 0, 1))
+
+			suppressed := 0
+			for i := range s.Data.Watering {
+				if s.Data.Watering[i] > 0 || s.Data.Shadow[i] > 0 {
+					t.Errorf("watered %v ms, shadow %v ms at %v", s.Data.Watering[i], s.Data.Shadow[i],
+						time.Unix(s.Data.Times[i], 0))
+				}
+				suppressed += s.Data.Suppressed[i]
+			}
+			if suppressed == 0 {
+				t.Error("no suppressed watering recorded")
+			}
+			// suppressed watering is not caught up
+			if !s.wateredSince(start) {
+				t.Error("suppressed watering not counted as handled")
+			}
+		})
+	}
+}
+
+func TestPinnedModelRestart(t *testing.T) {
+	dir := t.TempDir()
+	files := filesConfig{
+		Config:    filepath.Join(dir, "plant.conf"),
+		Data:      filepath.Join(dir, "data.json"),
+		WaterTime: filepath.Join(dir, "watertime.json"),
+	}
+	restart := func() *station {
+		s := &station{Config: defaultPlantConfig}
+		s.serverConfig.Files = files
+		s.readState()
+		return s
+	}
+
+	s := restart()
+	s.WateringTimeData = wateringTimeData{Scale: 100, Offset: 300}
+	if err := s.updateConfig([]byte(`{"model":{"scale":80,"offset":200}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := wateringTimeData{Scale: 80, Offset: 200}
+	if r := restart(); r.WateringTimeData != want {
+		t.Errorf("watering time data %+v after restart, want %+v", r.WateringTimeData, want)
+	}
+
+	// learned model saved after pinning, e.g. by an older version
+	b, err := json.Marshal(wateringTimeData{Scale: 100, Offset: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(files.WaterTime, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r := restart(); r.WateringTimeData != want {
+		t.Errorf("watering time data %+v after restart, want pinned %+v", r.WateringTimeData, want)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metrics collects counters and gauges exposed in Prometheus text format.
+type metrics struct {
+	mutex sync.Mutex
+
+	dryout             int
+	wateringTimeScale  int
+	wateringTimeOffset int
+	waterLimit         int
+
+	// i2c errors by command
+	i2cErrors map[string]int
+	// number and total duration of rotations
+	rotations       int
+	rotationSeconds float64
+	lastRotation    float64
+
+	cameraFailures int
+	// push script runs by exit code
+	pushRuns map[int]int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		i2cErrors: make(map[string]int),
+		pushRuns:  make(map[int]int),
+	}
+}
+
+func (m *metrics) setModel(dryout, wts, wto int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.dryout = dryout
+	m.wateringTimeScale = wts
+	m.wateringTimeOffset = wto
+}
+
+func (m *metrics) setWaterLimit(l int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.waterLimit = l
+}
+
+func (m *metrics) i2cError(cmd string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.i2cErrors[cmd]++
+}
+
+func (m *metrics) rotation(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.rotations++
+	m.rotationSeconds += d.Seconds()
+	m.lastRotation = d.Seconds()
+}
+
+func (m *metrics) cameraFailure() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.cameraFailures++
+}
+
+func (m *metrics) pushRun(code int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.pushRuns[code]++
+}
+
+func writeMetric(w io.Writer, name, typ, help string, v interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeMetric(w, "plantcare_dryout", "gauge", "Weight lost per 24h.", m.dryout)
+	writeMetric(w, "plantcare_watering_time_scale", "gauge", "Watering time per weight gain in ms.", m.wateringTimeScale)
+	writeMetric(w, "plantcare_watering_time_offset_ms", "gauge", "Watering time offset in ms.", m.wateringTimeOffset)
+	writeMetric(w, "plantcare_water_limit", "gauge", "Measured water limit of reservoir.", m.waterLimit)
+
+	fmt.Fprint(w, "# HELP plantcare_i2c_errors_total I2C errors by command.\n# TYPE plantcare_i2c_errors_total counter\n")
+	cmds := make([]string, 0, len(m.i2cErrors))
+	for c := range m.i2cErrors {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "plantcare_i2c_errors_total{cmd=%q} %d\n", c, m.i2cErrors[c])
+	}
+
+	fmt.Fprint(w, "# HELP plantcare_rotation_seconds Duration of rotations.\n# TYPE plantcare_rotation_seconds summary\n")
+	fmt.Fprintf(w, "plantcare_rotation_seconds_sum %v\nplantcare_rotation_seconds_count %d\n", m.rotationSeconds, m.rotations)
+	writeMetric(w, "plantcare_last_rotation_seconds", "gauge", "Duration of last rotation.", m.lastRotation)
+
+	writeMetric(w, "plantcare_camera_failures_total", "counter", "Failed picture captures.", m.cameraFailures)
+
+	fmt.Fprint(w, "# HELP plantcare_push_runs_total Runs of push script by exit code.\n# TYPE plantcare_push_runs_total counter\n")
+	codes := make([]int, 0, len(m.pushRuns))
+	for c := range m.pushRuns {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		fmt.Fprintf(w, "plantcare_push_runs_total{code=\"%d\"} %d\n", c, m.pushRuns[c])
+	}
+}
+
+// An instrumentedController counts errors and measures rotations of a
+// Controller.
+type instrumentedController struct {
+	Controller
+	metrics *metrics
+}
+
+func (c *instrumentedController) ReadWeight() (int, error) {
+	w, err := c.Controller.ReadWeight()
+	if err != nil {
+		c.metrics.i2cError("weight")
+	}
+	return w, err
+}
+
+func (c *instrumentedController) DoWatering(start, watering int) int {
+	t := c.Controller.DoWatering(start, watering)
+	if t == 0 && watering > 0 {
+		c.metrics.i2cError("watering")
+	}
+	return t
+}
+
+func (c *instrumentedController) Rotate(angle uint64) error {
+	start := time.Now()
+	err := c.Controller.Rotate(angle)
+	if err != nil {
+		c.metrics.i2cError("rotate")
+	} else {
+		c.metrics.rotation(time.Since(start))
+	}
+	return err
+}
+
+func (c *instrumentedController) ReadWateringLimit() (int, error) {
+	l, err := c.Controller.ReadWateringLimit()
+	if err != nil {
+		c.metrics.i2cError("waterlimit")
+	}
+	return l, err
+}
+
+func (c *instrumentedController) ReadLastWatering() (int, error) {
+	t, err := c.Controller.ReadLastWatering()
+	if err != nil {
+		c.metrics.i2cError("lastwatering")
+	}
+	return t, err
+}
+
+func (c *instrumentedController) SetRefillInterval(i uint8) error {
+	err := c.Controller.SetRefillInterval(i)
+	if err != nil {
+		c.metrics.i2cError("setrefill")
+	}
+	return err
+}
+
+func (c *instrumentedController) ReadRefillInterval() (int, error) {
+	r, err := c.Controller.ReadRefillInterval()
+	if err != nil {
+		c.metrics.i2cError("getrefill")
+	}
+	return r, err
+}
+
+func (c *instrumentedController) Echo(buf []byte) ([]byte, error) {
+	b, err := c.Controller.Echo(buf)
+	if err != nil {
+		c.metrics.i2cError("echo")
+	}
+	return b, err
+}
+
+func metricsHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		s.mutex.RLock()
+		if n := len(s.MinData.Weight); n > 0 {
+			writeMetric(w, "plantcare_weight", "gauge", "Last measured weight.", s.MinData.Weight[n-1])
+			writeMetric(w, "plantcare_weight_median", "gauge", "Median weight of last hour.", hourMedian(s.MinData.Weight, s.MinData.Quality))
+		}
+		for i := len(s.Data.Watering) - 1; i >= 0; i-- {
+			if s.Data.Watering[i] > 0 {
+				writeMetric(w, "plantcare_last_watering_ms", "gauge", "Duration of last watering.", s.Data.Watering[i])
+				break
+			}
+		}
+		s.mutex.RUnlock()
+
+		s.metrics.write(w)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxModelFits is the number of model fits kept.
+const maxModelFits = 100
+
+// A modelFit is a fit of dryout and watering model with its inputs.
+type modelFit struct {
+	// Time is the unix time of the fit.
+	Time   int64 `json:"time"`
+	Dryout int   `json:"dryout"`
+	Scale  int   `json:"scale"`
+	Offset int   `json:"offset"`
+	// Count is the number of fitted points including the two points of the
+	// previous model stabilizing the fit.
+	Count float32 `json:"count"`
+	// regression sums of weight gains and watering times
+	SumGain     float32 `json:"sumgain"`
+	SumGain2    float32 `json:"sumgain2"`
+	SumTime     float32 `json:"sumtime"`
+	SumGainTime float32 `json:"sumgaintime"`
+	// Clamped is "offset" or "scale" if the fit was clamped.
+	Clamped string `json:"clamped,omitempty"`
+	// Fallback is set if the fit failed and the previous model was kept.
+	Fallback bool `json:"fallback,omitempty"`
+	// Rollback is the time of the fit restored by a rollback, 0 for a
+	// regular fit.
+	Rollback int64 `json:"rollback,omitempty"`
+	// DryoutSamples are the hourly weight losses dryout is the trimmed mean
+	// of.
+	DryoutSamples []int        `json:"dryoutsamples"`
+	Points        []modelPoint `json:"points"`
+}
+
+// A modelPoint is a watering with its weight gain.
+type modelPoint struct {
+	// Time is the unix time of the watering.
+	Time     int64 `json:"time"`
+	Watering int   `json:"watering"`
+	Gain     int   `json:"gain"`
+}
+
+// convert converts the weights of the fit by factor k of weight differences
+// of a new calibration.
+func (f *modelFit) convert(k float64) {
+	round := func(v float64) int {
+		return int(math.Floor(v + 0.5))
+	}
+
+	f.Dryout = round(float64(f.Dryout) * k)
+	f.Scale = round(float64(f.Scale) / k)
+	f.SumGain *= float32(k)
+	f.SumGain2 *= float32(k * k)
+	f.SumGainTime *= float32(k)
+	samples := make([]int, len(f.DryoutSamples))
+	for i, d := range f.DryoutSamples {
+		samples[i] = round(float64(d) * k)
+	}
+	f.DryoutSamples = samples
+	points := make([]modelPoint, len(f.Points))
+	for i, p := range f.Points {
+		p.Gain = round(float64(p.Gain) * k)
+		points[i] = p
+	}
+	f.Points = points
+}
+
+// same reports whether the fits have the same result from the same inputs.
+func (f *modelFit) same(o *modelFit) bool {
+	return f.Dryout == o.Dryout && f.Scale == o.Scale && f.Offset == o.Offset &&
+		f.Count == o.Count && f.SumGain == o.SumGain && f.SumGain2 == o.SumGain2 &&
+		f.SumTime == o.SumTime && f.SumGainTime == o.SumGainTime
+}
+
+// fitModel calculates dryout per 24h and watering time scale and offset
+// from measurement data, must be called with locked mutex.
+func (s *station) fitModel() modelFit {
+	f := modelFit{
+		Time:          s.clock.Now().Unix(),
+		DryoutSamples: make([]int, 0, len(s.Data.Weight)),
+	}
+	prevw := 0
+	prevm := 0
+	var prevt int64
+	numw := len(s.Data.Watering)
+	numm := len(s.Data.Weight)
+
+	// number of waterings
+	wn := float32(0)
+	// weight gain sum
+	wgsum := float32(0)
+	// squared sum of weight gain
+	wgsum2 := float32(0)
+	// watering time sum
+	wtsum := float32(0)
+	// dot product of weight gains and watering times
+	wgwtdot := float32(0)
+
+	addWatering := func(wg, wt float32) {
+		wgsum += wg
+		wtsum += wt
+		wgsum2 += wg * wg
+		wgwtdot += wt * wg
+		wn++
+	}
+
+	for i, w := range s.Data.Watering {
+		if numw-i <= numm {
+			j := numm - numw + i
+			m := s.Data.Weight[j]
+			var t int64
+			if j < len(s.Data.Times) {
+				t = s.Data.Times[j]
+			}
+
+			// skip samples not measured, e.g. taken while busy, and
+			// samples before learning was reset
+			if j < len(s.Data.Quality) && s.Data.Quality[j] != qualityMeasured ||
+				t < s.WateringTimeData.Since {
+				m = 0
+			}
+
+			if prevm > 0 && m > 0 {
+				if prevw > 0 {
+					fw := float32(prevw)
+					wg := float32(m - prevm)
+					addWatering(wg, fw)
+					f.Points = append(f.Points, modelPoint{
+						Time:     prevt,
+						Watering: prevw,
+						Gain:     m - prevm,
+					})
+				} else {
+					f.DryoutSamples = append(f.DryoutSamples, prevm-m)
+				}
+			}
+			prevm = m
+			prevt = t
+		}
+		prevw = w
+	}
+
+	if s.WateringTimeData.Scale > 0 && wn > 0 {
+		// add two data points 12.5% around weightgain average calculated from previous data for stable results
+		wgavg := wgsum / wn
+		wg1 := (wgavg - wgavg/8)
+		wg2 := (wgavg + wgavg/8)
+		wt1 := wg1*float32(s.WateringTimeData.Scale) + float32(s.WateringTimeData.Offset)
+		wt2 := wg2*float32(s.WateringTimeData.Scale) + float32(s.WateringTimeData.Offset)
+
+		addWatering(wg1, wt1)
+		addWatering(wg2, wt2)
+	}
+
+	f.Count = wn
+	f.SumGain = wgsum
+	f.SumGain2 = wgsum2
+	f.SumTime = wtsum
+	f.SumGainTime = wgwtdot
+
+	if len(f.DryoutSamples) > 0 {
+		dryoutSamples := make([]int, len(f.DryoutSamples))
+		copy(dryoutSamples, f.DryoutSamples)
+		sort.Ints(dryoutSamples)
+		n := len(dryoutSamples)
+		// we filter one upper and one lower outlier per 6 hours
+		filterBounds := n / 6
+		a := dryoutSamples[filterBounds : n-filterBounds]
+		na := len(a)
+		sum := 0
+		for _, d := range a {
+			sum += d
+		}
+		f.Dryout = (sum*24 + na/2) / na
+	} else {
+		log.Println("no dryout meassured")
+		f.Dryout = 0
+	}
+
+	if wn > 0 && wgsum*wgsum < wgsum2*wn {
+		wts := (wgwtdot - wtsum*wgsum/wn) / (wgsum2 - wgsum*wgsum/wn)
+		f.Offset = int(wtsum/wn - wts*wgsum/wn)
+		f.Scale = int(wts)
+	} else {
+		log.Println("cannot calculate watering times")
+		log.Printf("wn: %v\n", wn)
+		log.Printf("wgsum: %v\n", wgsum)
+		log.Printf("wgsum2: %v\n", wgsum2)
+		log.Printf("wtsum: %v\n", wtsum)
+		log.Printf("wgwtdot: %v\n", wgwtdot)
+
+		// fallback to old settings
+		f.Offset = s.WateringTimeData.Offset
+		f.Scale = s.WateringTimeData.Scale
+		f.Fallback = true
+	}
+
+	// check results
+	if f.Offset < 0 {
+		// clamp offset to zero, and calculate line through center of mass
+		log.Printf("clamping offset:  %v, %v", f.Scale, f.Offset)
+		f.Clamped = "offset"
+		f.Offset = 0
+		if wgsum > 0 {
+			f.Scale = int(wtsum / wgsum)
+		}
+	} else if f.Scale < 0 {
+		// set offset to half of average watering time,
+		// and calculate line through center of mass
+		log.Printf("clamping scale:  %v, %v", f.Scale, f.Offset)
+		f.Clamped = "scale"
+		if wn > 0 {
+			f.Offset = int(0.5 * wtsum / wn)
+		}
+		f.Scale = int(wtsum * 0.5 / wgsum)
+	}
+
+	return f
+}
+
+// modelHeld reports whether a rolled back model is held, i.e. the last
+// model is a rollback and the fit has no watering newer than the rollback,
+// must be called with locked mutex.
+func (s *station) modelHeld(f *modelFit) bool {
+	n := len(s.models)
+	if n == 0 || s.models[n-1].Rollback == 0 {
+		return false
+	}
+	np := len(f.Points)
+	return np == 0 || f.Points[np-1].Time <= s.models[n-1].Time
+}
+
+// activeModel returns the fit with scale and offset of a pinned or held
+// model, must be called with locked mutex.
+func (s *station) activeModel(f modelFit) modelFit {
+	if p := s.Config.Model; p != nil {
+		f.Scale = p.Scale
+		f.Offset = p.Offset
+	} else if s.modelHeld(&f) {
+		f.Scale = s.WateringTimeData.Scale
+		f.Offset = s.WateringTimeData.Offset
+	}
+	return f
+}
+
+// applyPinnedModel makes scale and offset of a pinned model the current
+// watering model, must be called with locked mutex.
+func (s *station) applyPinnedModel() {
+	if p := s.Config.Model; p != nil {
+		log.Printf("watering model pinned: scale %v, offset %v", p.Scale, p.Offset)
+		s.WateringTimeData.Scale = p.Scale
+		s.WateringTimeData.Offset = p.Offset
+	}
+}
+
+// applyFit makes the fit the current watering model and adds it to the
+// model history unless it equals the last one or the model is pinned or a
+// rolled back model is held, must be called with locked mutex.
+func (s *station) applyFit(f modelFit) {
+	if s.Config.Model != nil || s.modelHeld(&f) {
+		return
+	}
+
+	s.WateringTimeData.Offset = f.Offset
+	s.WateringTimeData.Scale = f.Scale
+
+	if n := len(s.models); n > 0 && s.models[n-1].same(&f) {
+		return
+	}
+	s.addModel(f)
+}
+
+func (s *station) addModel(f modelFit) {
+	s.models = append(s.models, f)
+	if len(s.models) > maxModelFits {
+		s.models = s.models[len(s.models)-maxModelFits:]
+	}
+}
+
+// rollbackModel restores the watering model of the fit of given time and
+// holds it until a new watering is fitted.
+func (s *station) rollbackModel(t int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Config.Model != nil {
+		return fmt.Errorf("watering model is pinned")
+	}
+
+	var old *modelFit
+	for i := range s.models {
+		if s.models[i].Time == t {
+			old = &s.models[i]
+		}
+	}
+	if old == nil {
+		return fmt.Errorf("no model fit at %v", t)
+	}
+
+	log.Printf("rolling back watering model to fit at %v: scale %v, offset %v",
+		t, old.Scale, old.Offset)
+
+	f := *old
+	f.Time = s.clock.Now().Unix()
+	f.Rollback = t
+	s.WateringTimeData.Offset = f.Offset
+	s.WateringTimeData.Scale = f.Scale
+	s.addModel(f)
+	return nil
+}
+
+func (s *station) readModels() {
+	file := s.serverConfig.Files.Model
+	if file == "" {
+		return
+	}
+	err := readJSONFile(file, &s.models)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to read model history from %s: %v", file, err)
+	}
+}
+
+func (s *station) saveModels() error {
+	file := s.serverConfig.Files.Model
+	if file == "" {
+		return nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := json.Marshal(s.models)
+	if err != nil {
+		return fmt.Errorf("failed to marshal model history: %v", err)
+	}
+
+	err = writeFileAtomic(file, b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save model history to %s: %v", file, err)
+	}
+
+	return nil
+}
+
+// modelResidual is a watering with the watering time predicted by a model.
+type modelResidual struct {
+	modelPoint
+	Predicted int `json:"predicted"`
+	Residual  int `json:"residual"`
+}
+
+// residuals returns the differences of watering times of fitted waterings
+// and the times predicted by the fit.
+func (f *modelFit) residuals() []modelResidual {
+	r := make([]modelResidual, len(f.Points))
+	for i, p := range f.Points {
+		pred := p.Gain*f.Scale + f.Offset
+		r[i] = modelResidual{p, pred, p.Watering - pred}
+	}
+	return r
+}
+
+// modelHandler returns the current watering model, the history of fits and
+// residuals of the last fit or the fit at unix time given by "fit".
+func modelHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t int64
+		if v := r.URL.Query().Get("fit"); v != "" {
+			var err error
+			t, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid fit time: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+
+		var fit *modelFit
+		for i := range s.models {
+			if t == 0 || s.models[i].Time == t {
+				fit = &s.models[i]
+			}
+		}
+		if t != 0 && fit == nil {
+			http.Error(w, "fit not found", http.StatusNotFound)
+			return
+		}
+		cur := s.fitModel()
+
+		resp := struct {
+			Current   wateringTimeData `json:"current"`
+			Pinned    bool             `json:"pinned"`
+			Hold      bool             `json:"hold"`
+			Fits      []modelFit       `json:"fits"`
+			Fit       *modelFit        `json:"fit"`
+			Residuals []modelResidual  `json:"residuals"`
+		}{
+			Current: s.WateringTimeData,
+			Pinned:  s.Config.Model != nil,
+			Hold:    s.modelHeld(&cur),
+			Fits:    s.models,
+			Fit:     fit,
+		}
+		if fit != nil {
+			resp.Residuals = fit.residuals()
+		}
+
+		js, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
+
+// rollbackHandler restores the watering model of the fit at unix time given
+// by "fit".
+func rollbackHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		t, err := strconv.ParseInt(r.URL.Query().Get("fit"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid fit time: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.rollbackModel(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.checkpoint()
+
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// resetLearning discards samples before given time from fitting, e.g.
+// samples contaminated by a sensor fault. The current model is kept as
+// starting point.
+func (s *station) resetLearning(t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	log.Printf("resetting learning, discarding samples before %v", t)
+	s.WateringTimeData.Since = t.Unix()
+}
+
+// resetLearningHandler resets learning at current time or the unix time
+// given by "since".
+func resetLearningHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		t := s.clock.Now()
+		if v := r.URL.Query().Get("since"); v != "" {
+			u, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid time: %v", err), http.StatusBadRequest)
+				return
+			}
+			t = time.Unix(u, 0)
+		}
+
+		s.resetLearning(t)
+		s.checkpoint()
+
+		fmt.Fprint(w, "ok")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttTimeout    = 10 * time.Second
+	mqttMinBackoff = time.Second
+	mqttMaxBackoff = 5 * time.Minute
+	mqttQueueSize  = 64
+	// delay changes of the outbox are collected for before writing it
+	mqttSaveDelay = 5 * time.Second
+)
+
+type mqttMessage struct {
+	Topic    string `json:"topic"`
+	QoS      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+	Payload  string `json:"payload"`
+}
+
+// A mqttPublisher publishes messages to the broker from its own goroutine
+// and reconnects with backoff when connection is lost. Persistent messages
+// are kept in an outbox file until they are delivered.
+type mqttPublisher struct {
+	client MQTT.Client
+	queue  chan mqttMessage
+	// wake signals new messages in outbox
+	wake chan struct{}
+
+	mutex      sync.Mutex
+	outbox     []mqttMessage
+	outboxFile string
+	maxOutbox  int
+	// dirty is set while changes of outbox are not saved
+	dirty     bool
+	saveDelay time.Duration
+	saveTimer *time.Timer
+}
+
+func newTLSConfig(c mqttConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: c.Insecure,
+	}
+
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA %s: %v", c.CA, err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CA)
+		}
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+func newMQTTPublisher(c mqttConfig, outboxFile string, opts *MQTT.ClientOptions) (*mqttPublisher, error) {
+	opts.AddBroker(c.Server)
+	opts.SetClientID(c.ClientID)
+	opts.SetUsername(c.User)
+	opts.SetPassword(c.Pass)
+	// reconnecting is done by publisher
+	opts.SetAutoReconnect(false)
+
+	if c.CA != "" || c.Cert != "" || c.Insecure {
+		tc, err := newTLSConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tc)
+	}
+
+	p := &mqttPublisher{
+		client:     MQTT.NewClient(opts),
+		queue:      make(chan mqttMessage, mqttQueueSize),
+		wake:       make(chan struct{}, 1),
+		outboxFile: outboxFile,
+		maxOutbox:  c.MaxOutbox,
+		saveDelay:  mqttSaveDelay,
+	}
+
+	if outboxFile != "" {
+		err := readJSONFile(outboxFile, &p.outbox)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to read MQTT outbox: %v", err)
+		} else if len(p.outbox) > 0 {
+			log.Printf("%d messages in MQTT outbox", len(p.outbox))
+		}
+	}
+
+	go p.run()
+
+	return p, nil
+}
+
+// Publish queues message, returns error if queue is full.
+func (p *mqttPublisher) Publish(m mqttMessage) error {
+	select {
+	case p.queue <- m:
+		return nil
+	default:
+		return fmt.Errorf("MQTT queue full, dropping message to %s", m.Topic)
+	}
+}
+
+// PublishPersistent adds message to outbox, which is kept until message is
+// delivered. If outbox is full the oldest message is dropped.
+func (p *mqttPublisher) PublishPersistent(m mqttMessage) error {
+	p.mutex.Lock()
+	p.outbox = append(p.outbox, m)
+	if p.maxOutbox > 0 && len(p.outbox) > p.maxOutbox {
+		log.Printf("MQTT outbox full, dropping message to %s", p.outbox[0].Topic)
+		p.outbox = p.outbox[len(p.outbox)-p.maxOutbox:]
+	}
+	p.outboxChanged()
+	p.mutex.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// outboxChanged schedules saving of outbox, must be called with locked
+// mutex. Changes within saveDelay are written at once.
+func (p *mqttPublisher) outboxChanged() {
+	p.dirty = true
+	if p.saveTimer != nil || p.outboxFile == "" {
+		return
+	}
+	p.saveTimer = time.AfterFunc(p.saveDelay, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		p.saveTimer = nil
+		if err := p.saveOutbox(); err != nil {
+			log.Print(err)
+		}
+	})
+}
+
+// saveOutbox writes outbox to file if changed, must be called with locked
+// mutex.
+func (p *mqttPublisher) saveOutbox() error {
+	if p.outboxFile == "" || !p.dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(p.outbox)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(p.outboxFile, b, 0600); err != nil {
+		return fmt.Errorf("failed to save MQTT outbox: %v", err)
+	}
+	p.dirty = false
+	return nil
+}
+
+func (p *mqttPublisher) send(m mqttMessage) error {
+	token := p.client.Publish(m.Topic, m.QoS, m.Retained, m.Payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timeout while publishing to %s", m.Topic)
+	}
+	return token.Error()
+}
+
+// flushOutbox sends messages of outbox until it is empty or sending fails.
+func (p *mqttPublisher) flushOutbox() error {
+	for {
+		p.mutex.Lock()
+		if len(p.outbox) == 0 {
+			p.mutex.Unlock()
+			return nil
+		}
+		m := p.outbox[0]
+		p.mutex.Unlock()
+
+		if err := p.send(m); err != nil {
+			return err
+		}
+
+		p.mutex.Lock()
+		p.outbox = p.outbox[1:]
+		p.outboxChanged()
+		p.mutex.Unlock()
+	}
+}
+
+// dropQueue discards queued messages while broker is not reachable.
+func (p *mqttPublisher) dropQueue() {
+	n := 0
+	for {
+		select {
+		case <-p.queue:
+			n++
+		default:
+			if n > 0 {
+				log.Printf("dropped %d MQTT messages", n)
+			}
+			return
+		}
+	}
+}
+
+func (p *mqttPublisher) run() {
+	backoff := mqttMinBackoff
+
+	for {
+		if !p.client.IsConnected() {
+			log.Print("connecting to MQTT broker")
+			token := p.client.Connect()
+			err := fmt.Errorf("timeout after %v", mqttTimeout)
+			if token.WaitTimeout(mqttTimeout) {
+				err = token.Error()
+			}
+			if err != nil {
+				log.Printf("failed to connect to MQTT broker, retrying in %v: %v",
+					backoff, err)
+				p.dropQueue()
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > mqttMaxBackoff {
+					backoff = mqttMaxBackoff
+				}
+				continue
+			}
+			backoff = mqttMinBackoff
+		}
+
+		if err := p.flushOutbox(); err != nil {
+			log.Printf("failed to deliver MQTT outbox: %v", err)
+			time.Sleep(backoff)
+			continue
+		}
+
+		select {
+		case m := <-p.queue:
+			if err := p.send(m); err != nil {
+				log.Printf("failed to publish to %s: %v", m.Topic, err)
+			}
+		case <-p.wake:
+		case <-time.After(mqttTimeout):
+			// check connection
+		}
+	}
+}
+
+// Close saves pending changes of outbox, publishes message synchronously if
+// connected and disconnects.
+func (p *mqttPublisher) Close(last mqttMessage) {
+	p.mutex.Lock()
+	if p.saveTimer != nil {
+		p.saveTimer.Stop()
+		p.saveTimer = nil
+	}
+	if err := p.saveOutbox(); err != nil {
+		log.Print(err)
+	}
+	p.mutex.Unlock()
+
+	if !p.client.IsConnected() {
+		return
+	}
+	if err := p.send(last); err != nil {
+		log.Printf("failed to publish to %s: %v", last.Topic, err)
+	}
+	p.client.Disconnect(250)
+}
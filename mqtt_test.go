@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutboxSaveDebounced(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "outbox.json")
+	p := &mqttPublisher{
+		wake:       make(chan struct{}, 1),
+		outboxFile: file,
+		saveDelay:  50 * time.Millisecond,
+	}
+
+	for i := 0; i < 10; i++ {
+		p.PublishPersistent(mqttMessage{Topic: "plant/water", QoS: 2, Payload: "1000"})
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("outbox written before delay: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(file); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("outbox not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var outbox []mqttMessage
+	if err := readJSONFile(file, &outbox); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox) != 10 {
+		t.Errorf("saved %d messages, want 10", len(outbox))
+	}
+	// written once, no previous version
+	if _, err := os.Stat(file + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("outbox written more than once: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttCommand is the payload of a command received on <topic>/cmd/<name>.
+type mqttCommand struct {
+	// ID is returned in the result for correlation.
+	ID string `json:"id"`
+	// Start and Time are the watering start and watering time in ms.
+	Start *int `json:"start"`
+	Time  int  `json:"time"`
+	// Angle is the rotation angle in degrees.
+	Angle *int `json:"angle"`
+	// Interval is the refill interval, reads current interval if missing.
+	Interval *int `json:"interval"`
+	// Config is merged into the plant config.
+	Config json.RawMessage `json:"config"`
+	// EV and Shrink are exposure compensation and shrink factor of picture.
+	EV     int  `json:"ev"`
+	Shrink *int `json:"shrink"`
+}
+
+// mqttResult is published on <topic>/result for each command.
+type mqttResult struct {
+	ID      string      `json:"id"`
+	Command string      `json:"cmd"`
+	OK      bool        `json:"ok"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// subscribeCommands subscribes to command topics, it is called on each
+// connect to the broker.
+func (s *station) subscribeCommands(c MQTT.Client) {
+	topic := s.MQTT.Topic + "/cmd/+"
+	token := c.Subscribe(topic, 1, func(c MQTT.Client, m MQTT.Message) {
+		// commands may take a while, don't block the client
+		go s.handleCommand(m.Topic(), m.Payload())
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Printf("failed to subscribe to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("subscribed to %s", topic)
+}
+
+func (s *station) handleCommand(topic string, payload []byte) {
+	name := topic[strings.LastIndex(topic, "/")+1:]
+
+	var cmd mqttCommand
+	res := mqttResult{Command: name}
+
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			res.Error = fmt.Sprintf("invalid command: %v", err)
+			s.publishResult(res)
+			return
+		}
+	}
+	res.ID = cmd.ID
+
+	log.Printf("mqtt command %s(%s)", name, cmd.ID)
+
+	var err error
+	res.Result, err = s.runCommand(name, &cmd)
+	if err != nil {
+		log.Printf("mqtt command %s(%s) failed: %v", name, cmd.ID, err)
+		res.Error = err.Error()
+	} else {
+		res.OK = true
+	}
+
+	s.publishResult(res)
+}
+
+func (s *station) runCommand(name string, cmd *mqttCommand) (interface{}, error) {
+	switch name {
+	case "water":
+		if cmd.Time <= 0 {
+			return nil, fmt.Errorf("missing watering time")
+		}
+		s.mutex.RLock()
+		st := s.Config.WaterStart
+		s.mutex.RUnlock()
+		if cmd.Start != nil {
+			st = *cmd.Start
+		}
+		t := s.wuc.DoWatering(st, cmd.Time)
+		if err := s.publishPersistent(s.MQTT.Topic+"/water", byte(2), fmt.Sprint(t)); err != nil {
+			log.Printf("failed to publish watering: %v", err)
+		}
+		return t, nil
+
+	case "rotate":
+		if cmd.Angle == nil {
+			return nil, fmt.Errorf("missing angle")
+		}
+		if *cmd.Angle < 0 {
+			return nil, fmt.Errorf("negative angles not allowed")
+		}
+		return nil, s.wuc.Rotate(uint64(*cmd.Angle))
+
+	case "refill":
+		if cmd.Interval == nil {
+			return s.wuc.ReadRefillInterval()
+		}
+		if *cmd.Interval < 0 || *cmd.Interval > 240 {
+			return nil, fmt.Errorf("invalid interval")
+		}
+		return nil, s.wuc.SetRefillInterval(uint8(*cmd.Interval))
+
+	case "config":
+		if len(cmd.Config) > 0 {
+			if err := s.updateConfig(cmd.Config); err != nil {
+				return nil, err
+			}
+		}
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		return s.Config, nil
+
+	case "picture":
+		shrink := 4
+		if cmd.Shrink != nil {
+			shrink = *cmd.Shrink
+		}
+		file, err := s.cam.TakePicture("", cmd.EV, uint(shrink))
+		if file != "" {
+			defer os.Remove(file)
+		}
+		if err != nil {
+			s.metrics.cameraFailure()
+			return nil, fmt.Errorf("failed to take picture: %v", err)
+		}
+		img, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image file: %v", err)
+		}
+		if err := s.publish(s.MQTT.Topic+"/picture", byte(1), false, string(img)); err != nil {
+			return nil, err
+		}
+		return len(img), nil
+	}
+
+	return nil, fmt.Errorf("unknown command: %s", name)
+}
+
+func (s *station) publishResult(res mqttResult) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("failed to marshal mqtt result: %v", err)
+		return
+	}
+	if err := s.publish(s.MQTT.Topic+"/result", byte(1), false, string(b)); err != nil {
+		log.Printf("failed to publish mqtt result: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it
+// to file, so that file always contains either the old or the new data.
+// The previous version of file is kept as backup, which is linked or copied
+// before, so file is never missing.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(file)
+
+	f, err := ioutil.TempFile(dir, filepath.Base(file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if _, err := os.Stat(file); err == nil {
+		if err := backupFile(file, file+".bak", perm); err != nil {
+			log.Printf("failed to keep backup of %s: %v", file, err)
+		}
+	}
+
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// sync directory to persist rename
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// backupFile replaces bak with a hard link to file, or a copy if the file
+// system does not support links.
+func backupFile(file, bak string, perm os.FileMode) error {
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(file, bak); err == nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bak, b, perm)
+}
+
+// readJSONFile unmarshals file into v. If file is corrupt it is moved aside
+// and the backup written by writeFileAtomic is read instead. Returns an
+// error satisfying os.IsNotExist if neither file exists.
+func readJSONFile(file string, v interface{}) error {
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(b, v)
+		if err == nil {
+			return nil
+		}
+
+		corrupt := file + ".corrupt"
+		log.Printf("%s is corrupt, moving it to %s: %v", file, corrupt, err)
+		if err := os.Rename(file, corrupt); err != nil {
+			log.Printf("failed to move %s: %v", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	bak := file + ".bak"
+	b, berr := ioutil.ReadFile(bak)
+	if berr != nil {
+		if os.IsNotExist(berr) && !os.IsNotExist(err) {
+			return fmt.Errorf("no backup to recover corrupt %s", file)
+		}
+		return berr
+	}
+
+	log.Printf("recovering from backup %s", bak)
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("backup %s is corrupt: %v", bak, err)
+	}
+
+	return nil
+}
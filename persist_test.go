@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.json")
+
+	for _, data := range []string{`{"v":1}`, `{"v":2}`, `{"v":3}`} {
+		if err := writeFileAtomic(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("file contains %s, want %s", b, data)
+		}
+	}
+
+	b, err := ioutil.ReadFile(file + ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"v":2}` {
+		t.Errorf("backup contains %s, want previous version", b)
+	}
+
+	// corrupt file is recovered from backup
+	var v struct{ V int }
+	if err := readJSONFile(file, &v); err != nil || v.V != 3 {
+		t.Errorf("read %v, %v, want 3", v.V, err)
+	}
+	if err := ioutil.WriteFile(file, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := readJSONFile(file, &v); err != nil || v.V != 2 {
+		t.Errorf("recovered %v, %v, want 2 from backup", v.V, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// reservoir alarm states
+const (
+	reservoirOK = ""
+	// level below warning level or running out within warning days
+	reservoirLow = "low"
+	// level below safe level of pump
+	reservoirEmpty = "empty"
+)
+
+// reservoirEstimateHours is the period consumption is estimated from.
+const reservoirEstimateHours = 7 * 24
+
+// reservoirStatus is the reservoir level with estimated consumption.
+type reservoirStatus struct {
+	// Level is the last measured level, -1 if unknown.
+	Level int `json:"level"`
+	// Consumption is the level used per day, 0 if unknown.
+	Consumption float64 `json:"consumption"`
+	// Days is the estimated number of days until the safe level is
+	// reached, -1 if unknown.
+	Days  float64 `json:"days"`
+	Alarm string  `json:"alarm,omitempty"`
+}
+
+// readReservoir returns the reservoir level, -1 if reading failed.
+func (s *station) readReservoir() int {
+	l, err := s.wuc.ReadWateringLimit()
+	if err != nil {
+		log.Println("failed to read watering limit: ", err)
+		return -1
+	}
+	return l
+}
+
+// reservoirEmpty reports whether level is below the safe level of pump.
+func (s *station) reservoirEmpty(level int) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return level >= 0 && level < s.Config.ReservoirSafe
+}
+
+// reservoirConsumption returns the average level drop per day of given
+// samples, rising levels by refills are ignored.
+func reservoirConsumption(times []int64, levels []int) float64 {
+	used := 0
+	var first, last int64
+	prev := -1
+	for i, l := range levels {
+		if l < 0 || i >= len(times) {
+			continue
+		}
+		if prev >= 0 && l < prev {
+			used += prev - l
+		}
+		if first == 0 {
+			first = times[i]
+		}
+		last = times[i]
+		prev = l
+	}
+
+	days := float64(last-first) / (24 * 60 * 60)
+	if days < 1 {
+		return 0
+	}
+	return float64(used) / days
+}
+
+// updateReservoir estimates remaining days of reservoir and raises or
+// clears the reservoir alarm.
+func (s *station) updateReservoir() {
+	s.mutex.Lock()
+
+	n := len(s.Data.Reservoir)
+	i0 := n - reservoirEstimateHours
+	if i0 < 0 {
+		i0 = 0
+	}
+	st := reservoirStatus{Level: -1, Days: -1}
+	if n > 0 {
+		st.Level = s.Data.Reservoir[n-1]
+	}
+	if len(s.Data.Times) == n {
+		st.Consumption = reservoirConsumption(s.Data.Times[i0:], s.Data.Reservoir[i0:])
+	}
+	c := &s.Config
+	if st.Level >= 0 && st.Consumption > 0 {
+		st.Days = float64(st.Level-c.ReservoirSafe) / st.Consumption
+		if st.Days < 0 {
+			st.Days = 0
+		}
+	}
+
+	switch {
+	case st.Level < 0:
+		// keep state while level is unknown
+		st.Alarm = s.Reservoir.Alarm
+	case st.Level < c.ReservoirSafe:
+		st.Alarm = reservoirEmpty
+	case st.Level < c.ReservoirLow,
+		st.Days >= 0 && st.Days < float64(c.ReservoirDays):
+		st.Alarm = reservoirLow
+	}
+
+	changed := st.Alarm != s.Reservoir.Alarm
+	s.Reservoir = st
+	s.mutex.Unlock()
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		log.Printf("failed to marshal reservoir status: %v", err)
+		return
+	}
+	s.publish(s.MQTT.Topic+"/reservoir", byte(0), true, string(b))
+
+	if changed {
+		if st.Alarm != reservoirOK {
+			s.alerts.raiseState(alertReservoir, st.Alarm, "reservoir %s, level %v, %.1f days left", st.Alarm, st.Level, st.Days)
+		} else {
+			s.alerts.raiseState(alertReservoir, "ok", "reservoir alarm cleared, level %v", st.Level)
+		}
+		s.publish(s.MQTT.Topic+"/alarm/reservoir", byte(1), true, string(b))
+	}
+}
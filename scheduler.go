@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A cronSchedule is a parsed cron expression with fields minute, hour, day
+// of month, month and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// day of month or week restricted, a day matches either if both are
+	domStar, dowStar bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a cron expression of five fields, each a list of values,
+// ranges and steps, e.g. "*/15 6-22 * * 1,3,5".
+func parseCron(spec string) (*cronSchedule, error) {
+	if a, ok := cronAliases[spec]; ok {
+		spec = a
+	}
+
+	f := strings.Fields(spec)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", spec)
+	}
+
+	var c cronSchedule
+	var err error
+	fields := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, fd := range fields {
+		*fd.bits, err = parseCronField(f[i], fd.min, fd.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", spec, err)
+		}
+	}
+
+	// 7 is sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = f[2] == "*"
+	c.dowStar = f[4] == "*"
+
+	return &c, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(r[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", r[0])
+			}
+			hi = lo
+			if len(r) == 2 {
+				hi, err = strconv.Atoi(r[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", r[1])
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t matching the schedule in location of
+// loc, or the zero time if there is none within five years. A time skipped
+// by a DST transition does not match, a repeated time matches twice.
+func (c *cronSchedule) next(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc).Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = truncateHour(t).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// jobConfig configures the schedule of a periodic job.
+type jobConfig struct {
+	// Cron is the cron expression of the job, empty disables the job.
+	Cron string
+	// TZ is the time zone the cron expression is evaluated in, empty for
+	// local time.
+	TZ string
+}
+
+// A job is a periodic task of the station.
+type job struct {
+	name string
+	// config returns the current schedule of the job.
+	config func() jobConfig
+	run    func(t time.Time)
+
+	// after is the time the next run is scheduled after
+	after time.Time
+	last  time.Time
+	next  time.Time
+}
+
+// A scheduler runs jobs at the times of their cron expressions on a clock.
+// Jobs due at the same time run in the order they were added. A job running
+// late skips missed runs.
+type scheduler struct {
+	clock clock
+	mutex sync.Mutex
+	jobs  []*job
+}
+
+func newScheduler(clk clock) *scheduler {
+	return &scheduler{clock: clk}
+}
+
+func (sc *scheduler) add(name string, config func() jobConfig, run func(t time.Time)) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	sc.jobs = append(sc.jobs, &job{
+		name:   name,
+		config: config,
+		run:    run,
+		after:  sc.clock.Now(),
+	})
+}
+
+// resume lets the named job run at start for its latest run missed since
+// last, e.g. while the station was down, instead of waiting for its next
+// run.
+func (sc *scheduler) resume(name string, last time.Time) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	now := sc.clock.Now()
+	for _, j := range sc.jobs {
+		if j.name != name {
+			continue
+		}
+		c := j.config()
+		if c.Cron == "" {
+			return
+		}
+		cs, err := parseCron(c.Cron)
+		if err != nil {
+			log.Printf("job %s: %v", j.name, err)
+			return
+		}
+		loc, err := loadLocation(c.TZ)
+		if err != nil {
+			log.Printf("job %s: %v", j.name, err)
+			return
+		}
+
+		var missed time.Time
+		for t := cs.next(last, loc); !t.IsZero() && !t.After(now); t = cs.next(t, loc) {
+			missed = t
+		}
+		if !missed.IsZero() {
+			log.Printf("job %s missed at %v", j.name, missed.Format("15:04 MST"))
+			j.after = missed.Add(-time.Minute)
+		}
+	}
+}
+
+// schedule updates the next run times from the current job configs and
+// returns the earliest, zero if no job is scheduled.
+func (sc *scheduler) schedule() time.Time {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	var next time.Time
+	for _, j := range sc.jobs {
+		j.next = time.Time{}
+		c := j.config()
+		if c.Cron == "" {
+			continue
+		}
+		cs, err := parseCron(c.Cron)
+		if err != nil {
+			log.Printf("job %s: %v", j.name, err)
+			continue
+		}
+		loc, err := loadLocation(c.TZ)
+		if err != nil {
+			log.Printf("job %s: %v", j.name, err)
+			continue
+		}
+		j.next = cs.next(j.after, loc)
+		if !j.next.IsZero() && (next.IsZero() || j.next.Before(next)) {
+			next = j.next
+		}
+	}
+	return next
+}
+
+func loadLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(tz)
+}
+
+// runUntil runs the jobs until given time, or forever if end is zero.
+func (sc *scheduler) runUntil(end time.Time) {
+	for {
+		next := sc.schedule()
+		if next.IsZero() {
+			log.Print("no jobs scheduled")
+			return
+		}
+		if !end.IsZero() && next.After(end) {
+			return
+		}
+
+		sc.clock.Sleep(next.Sub(sc.clock.Now()))
+
+		sc.mutex.Lock()
+		jobs := make([]*job, len(sc.jobs))
+		copy(jobs, sc.jobs)
+		sc.mutex.Unlock()
+
+		for _, j := range jobs {
+			if j.next.IsZero() || j.next.After(next) {
+				continue
+			}
+			log.Printf("job %s at %v", j.name, j.next.Format("15:04 MST"))
+			j.run(j.next)
+
+			sc.mutex.Lock()
+			j.last = j.next
+			j.after = sc.clock.Now()
+			sc.mutex.Unlock()
+		}
+	}
+}
+
+// jobStatus is the schedule of a job reported over the API.
+type jobStatus struct {
+	Name string `json:"name"`
+	Cron string `json:"cron"`
+	TZ   string `json:"tz,omitempty"`
+	// Last and Next are unix times of last and next run, 0 if none.
+	Last int64 `json:"last"`
+	Next int64 `json:"next"`
+}
+
+func (sc *scheduler) status() []jobStatus {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+
+	st := make([]jobStatus, len(sc.jobs))
+	for i, j := range sc.jobs {
+		c := j.config()
+		st[i] = jobStatus{
+			Name: j.name,
+			Cron: c.Cron,
+			TZ:   c.TZ,
+			Last: unix(j.last),
+			Next: unix(j.next),
+		}
+	}
+	return st
+}
+
+func scheduleHandler(s *station) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		js, err := json.Marshal(s.scheduler.status())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
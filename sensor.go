@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+// sensorConfig configures filtering of minute weight samples and detection
+// of sensor failures.
+type sensorConfig struct {
+	// Spike is the deviation from the median of recent samples a sample is
+	// rejected as outlier at, 0 disables filtering.
+	Spike int
+	// SpikeMinutes is the number of consecutive consistent outliers after
+	// which the new weight is accepted as a step, e.g. after watering.
+	SpikeMinutes int
+	// StuckMinutes is the number of minutes of identical raw readings after
+	// which the sensor is considered stuck, 0 disables the check. A healthy
+	// reading may not change for hours with the coarse quantization of the
+	// load cell, so it should span a day of dryout.
+	StuckMinutes int
+	// FailMinutes is the number of consecutive failed readings after which
+	// the sensor is considered dead, 0 disables the check.
+	FailMinutes int
+	// Settle is the time in seconds samples are flagged busy after the
+	// plant was rotated or watered.
+	Settle int
+}
+
+var defaultSensorConfig = sensorConfig{
+	Spike:        50,
+	SpikeMinutes: 5,
+	StuckMinutes: 24 * 60,
+	FailMinutes:  10,
+	Settle:       120,
+}
+
+// sensor health states
+const (
+	sensorOK    = ""
+	sensorStuck = "stuck"
+	sensorDead  = "dead"
+)
+
+// sensorWindow is the number of recent measured samples the median an
+// outlier is detected against is taken from.
+const sensorWindow = 5
+
+// sensorHealth is the state of the weight sensor. Automatic watering is
+// disabled while the state is not OK.
+type sensorHealth struct {
+	State string `json:"state,omitempty"`
+	// Failures is the number of consecutive failed readings.
+	Failures int `json:"failures"`
+	// Stuck is the number of consecutive identical raw readings.
+	Stuck int `json:"stuck"`
+	// Outliers are the consecutive rejected weights.
+	Outliers []int `json:"outliers,omitempty"`
+
+	lastRaw int
+}
+
+// sensorFailed reports whether the sensor is stuck or dead.
+func (s *station) sensorFailed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.Sensor.State != sensorOK
+}
+
+// filterWeight checks a minute weight against the median of recent
+// measured samples and returns the weight to record with its quality, must
+// be called with locked mutex. An outlier is replaced by the median unless
+// enough consistent outliers indicate a step of weight, then the outliers
+// recorded so far are restored.
+func (s *station) filterWeight(w int) (int, int) {
+	c := s.serverConfig.Sensor
+	h := &s.Sensor
+	med, ok := measuredMedian(s.MinData.Weight, s.MinData.Quality, sensorWindow)
+	if c.Spike <= 0 || !ok || abs(w-med) <= c.Spike {
+		h.Outliers = nil
+		return w, qualityMeasured
+	}
+
+	// a step needs at least two outliers to be told from a spike
+	n := c.SpikeMinutes
+	if n < 2 {
+		n = 2
+	}
+	h.Outliers = append(h.Outliers, w)
+	if len(h.Outliers) > n {
+		h.Outliers = h.Outliers[1:]
+	}
+	if len(h.Outliers) < n || spread(h.Outliers) > c.Spike {
+		log.Printf("rejected weight %v, median %v", w, med)
+		return med, qualityOutlier
+	}
+
+	log.Printf("accepted weight step from %v to %v", med, w)
+	j := len(h.Outliers) - 2
+	d := &s.MinData
+	for i := len(d.Weight) - 1; i >= 0 && j >= 0; i-- {
+		if d.Quality[i] == qualityOutlier {
+			d.Weight[i] = h.Outliers[j]
+			d.Quality[i] = qualityMeasured
+			j--
+		}
+	}
+	h.Outliers = nil
+	return w, qualityMeasured
+}
+
+// measuredMedian returns the median of the last n measured samples.
+func measuredMedian(weight, quality []int, n int) (int, bool) {
+	var d []int
+	for i := len(weight) - 1; i >= 0 && len(d) < n; i-- {
+		if i < len(quality) && quality[i] == qualityMeasured {
+			d = append(d, weight[i])
+		}
+	}
+	// not enough samples to tell an outlier
+	if len(d) < (n+1)/2 {
+		return 0, false
+	}
+	sort.Ints(d)
+	return d[len(d)/2], true
+}
+
+func spread(v []int) int {
+	min, max := v[0], v[0]
+	for _, x := range v[1:] {
+		if x < min {
+			min = x
+		} else if x > max {
+			max = x
+		}
+	}
+	return max - min
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// updateSensorHealth updates the sensor health from a reading, err is the
+// error of a failed reading, must be called with locked mutex. It returns
+// whether the state changed.
+func (s *station) updateSensorHealth(raw int, err error) bool {
+	c := s.serverConfig.Sensor
+	h := &s.Sensor
+
+	if err != nil {
+		h.Failures++
+	} else {
+		h.Failures = 0
+		if raw == h.lastRaw {
+			h.Stuck++
+		} else {
+			h.Stuck = 0
+		}
+		h.lastRaw = raw
+	}
+
+	state := sensorOK
+	if c.FailMinutes > 0 && h.Failures >= c.FailMinutes {
+		state = sensorDead
+	} else if c.StuckMinutes > 0 && h.Stuck >= c.StuckMinutes {
+		state = sensorStuck
+	} else if err != nil {
+		// keep state until a successful reading
+		state = h.State
+	}
+
+	changed := state != h.State
+	h.State = state
+	return changed
+}
+
+// sensorHealthChanged raises or clears the sensor alert and publishes the
+// sensor health.
+func (s *station) sensorHealthChanged() {
+	s.mutex.RLock()
+	h := s.Sensor
+	s.mutex.RUnlock()
+
+	switch h.State {
+	case sensorDead:
+		s.alerts.raiseState(alertSensor, h.State, "weight sensor failed %v times, automatic watering disabled", h.Failures)
+	case sensorStuck:
+		s.alerts.raiseState(alertSensor, h.State, "weight sensor stuck for %v minutes, automatic watering disabled", h.Stuck)
+	default:
+		s.alerts.raiseState(alertSensor, "ok", "weight sensor recovered, automatic watering enabled")
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		log.Printf("failed to marshal sensor health: %v", err)
+		return
+	}
+	s.publish(s.MQTT.Topic+"/alarm/sensor", byte(1), true, string(b))
+}
+
+// busyController marks the station busy while the plant is rotated or
+// watered.
+type busyController struct {
+	Controller
+	s *station
+}
+
+func (c *busyController) Rotate(angle uint64) error {
+	defer c.s.actuatorBusy()()
+	return c.Controller.Rotate(angle)
+}
+
+func (c *busyController) DoWatering(start, watering int) int {
+	defer c.s.actuatorBusy()()
+	return c.Controller.DoWatering(start, watering)
+}
+
+// actuatorBusy marks the start of an operation disturbing the weight, the
+// returned function marks its end. Samples are flagged busy until the last
+// operation ended and settled.
+func (s *station) actuatorBusy() func() {
+	s.mutex.Lock()
+	s.busy++
+	s.mutex.Unlock()
+
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		s.busy--
+		settled := s.clock.Now().Add(time.Duration(s.serverConfig.Sensor.Settle) * time.Second)
+		if settled.After(s.settled) {
+			s.settled = settled
+		}
+	}
+}
+
+// busyAt reports whether an operation disturbs the weight at t, must be
+// called with locked mutex.
+func (s *station) busyAt(t time.Time) bool {
+	return s.busy > 0 || t.Before(s.settled)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStuckSensor(t *testing.T) {
+	const days = 2
+
+	tests := []struct {
+		name string
+		// raw returns the reading at minute m
+		raw   func(m int) int
+		stuck bool
+	}{
+		{
+			// 60 counts of dryout per day in steps of 8 counts, the
+			// reading stays the same for more than three hours
+			name: "slow drift",
+			raw:  func(m int) int { return 20000 - m*60/(24*60)/8*8 },
+		},
+		{
+			name:  "identical readings",
+			raw:   func(m int) int { return 20000 },
+			stuck: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &station{}
+			s.serverConfig.Sensor = defaultSensorConfig
+
+			for m := 0; m < days*24*60; m++ {
+				s.updateSensorHealth(tt.raw(m), nil)
+				if s.Sensor.State == sensorStuck {
+					if !tt.stuck {
+						t.Fatalf("stuck after %v", time.Duration(m)*time.Minute)
+					}
+					return
+				}
+			}
+			if tt.stuck {
+				t.Errorf("not stuck after %v days", days)
+			}
+		})
+	}
+}
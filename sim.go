@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type simConfig struct {
+	// Weight is the initial weight of the pot.
+	Weight int
+	// Dryout is the average weight lost by evapotranspiration per 24h.
+	Dryout int
+	// DayNight is the relative variation of evapotranspiration over the
+	// day, peaking at noon, 0 for constant evapotranspiration.
+	DayNight float64
+	// Flow is the weight gain per ms of watering.
+	Flow float64
+	// Reservoir is the initial water limit.
+	Reservoir int
+	// Noise is the maximum deviation of a weight reading.
+	Noise int
+	// FailureRate is the probability of a failed weight reading.
+	FailureRate float64
+	// RotationTime is the time in ms for a full revolution of the plate.
+	RotationTime int
+	// Seed initializes the random number generator, 0 seeds with time.
+	Seed int64
+}
+
+var defaultSimConfig = simConfig{
+	Weight:       1450,
+	Dryout:       60,
+	DayNight:     0.5,
+	Flow:         0.01,
+	Reservoir:    200,
+	Noise:        2,
+	RotationTime: 10000,
+}
+
+// A SimWuc simulates the Watering Micro Controller and the plant in
+// software.
+type SimWuc struct {
+	config simConfig
+	clock  clock
+	mutex  *sync.Mutex
+	rand   *rand.Rand
+
+	// weight of pot at time of last update
+	weight  float64
+	updated time.Time
+
+	// position of plate in counts
+	position uint
+	// last watering in units of 250ms
+	lastWatering byte
+	refill       uint8
+	reservoir    float64
+}
+
+// NewSimWuc creates a simulated Wuc running on given clock, zero values in
+// c are replaced by defaults.
+func NewSimWuc(c simConfig, clk clock) *SimWuc {
+	d := defaultSimConfig
+	if c.Weight == 0 {
+		c.Weight = d.Weight
+	}
+	if c.Dryout == 0 {
+		c.Dryout = d.Dryout
+	}
+	if c.Flow == 0 {
+		c.Flow = d.Flow
+	}
+	if c.Reservoir == 0 {
+		c.Reservoir = d.Reservoir
+	}
+	if c.RotationTime == 0 {
+		c.RotationTime = d.RotationTime
+	}
+	if c.Seed == 0 {
+		c.Seed = time.Now().UnixNano()
+	}
+
+	log.Printf("simulating controller: %+v", c)
+
+	return &SimWuc{
+		config:    c,
+		clock:     clk,
+		mutex:     &sync.Mutex{},
+		rand:      rand.New(rand.NewSource(c.Seed)),
+		weight:    float64(c.Weight),
+		updated:   clk.Now(),
+		reservoir: float64(c.Reservoir),
+	}
+}
+
+// evaporation returns the weight lost by evapotranspiration between t0 and
+// t1. The rate varies sinusoidally over the day with its peak at noon.
+func (w *SimWuc) evaporation(t0, t1 time.Time) float64 {
+	const day = 24 * float64(time.Hour)
+	const omega = 2 * math.Pi / day
+
+	// time since 6:00 local
+	phase := func(t time.Time) float64 {
+		y, m, d := t.Date()
+		six := time.Date(y, m, d, 6, 0, 0, 0, t.Location())
+		return float64(t.Sub(six))
+	}
+
+	rate := float64(w.config.Dryout) / day
+	dt := float64(t1.Sub(t0))
+	// integral of rate * (1 + a*sin(omega*phase))
+	p0 := phase(t0)
+	p1 := p0 + dt
+	dn := w.config.DayNight / omega * (math.Cos(omega*p0) - math.Cos(omega*p1))
+
+	return rate * (dt + dn)
+}
+
+// evaporate updates weight by evapotranspiration since last update.
+func (w *SimWuc) evaporate() {
+	now := w.clock.Now()
+	w.weight -= w.evaporation(w.updated, now)
+	w.updated = now
+	if w.weight < 0 {
+		w.weight = 0
+	}
+}
+
+// TrueWeight returns the simulated weight without sensor noise.
+func (w *SimWuc) TrueWeight() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.evaporate()
+	return int(w.weight + 0.5)
+}
+
+// Reservoir returns the remaining water of the reservoir.
+func (w *SimWuc) Reservoir() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return int(w.reservoir)
+}
+
+// ReadWeight returns simulated weight including sensor noise.
+func (w *SimWuc) ReadWeight() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.clock.Sleep(700 * time.Millisecond)
+
+	if w.config.FailureRate > 0 && w.rand.Float64() < w.config.FailureRate {
+		return 0, fmt.Errorf("failed to measure weight")
+	}
+
+	w.evaporate()
+	m := int(w.weight + 0.5)
+	if w.config.Noise > 0 {
+		m += w.rand.Intn(2*w.config.Noise+1) - w.config.Noise
+	}
+
+	return m, nil
+}
+
+// DoWatering simulates pump with given start and watering time.
+func (w *SimWuc) DoWatering(start, watering int) int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	s := (start + 125) / 250
+	if s < 0 || s > 255 {
+		log.Printf("watering start time out of range: %v(%v)", s, start)
+		return 0
+	}
+
+	u := (watering + 125) / 250
+	if u < 0 || u > 255 {
+		log.Printf("watering time out of range: %v(%v)", u, watering)
+		return 0
+	}
+
+	log.Printf("simulated watering %v+%v ms", s*250, u*250)
+	w.clock.Sleep(time.Duration(s*250+u*250) * time.Millisecond)
+
+	w.evaporate()
+
+	// pump runs dry when reservoir is empty
+	t := float64(u * 250)
+	if gain := t * w.config.Flow; gain > w.reservoir {
+		t = w.reservoir / w.config.Flow
+	}
+	gain := t * w.config.Flow
+	w.weight += gain
+	w.reservoir -= gain
+
+	w.lastWatering = byte(int(t) / 250)
+
+	return int(w.lastWatering) * 250
+}
+
+// Rotate simulates turning of plate to given angle.
+func (w *SimWuc) Rotate(angle uint64) error {
+	a := uint((angle * CPR / 360) % CPR)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	log.Printf("simulated rotating to %v(%v°)", a, a*360/CPR)
+
+	// plate turns only in one direction
+	d := (a + CPR - w.position) % CPR
+	w.clock.Sleep(time.Duration(int(d)*w.config.RotationTime/CPR) * time.Millisecond)
+	w.position = a
+
+	return nil
+}
+
+// ReadWateringLimit returns the remaining water of simulated reservoir.
+func (w *SimWuc) ReadWateringLimit() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return int(w.reservoir), nil
+}
+
+// ReadLastWatering returns duration of last simulated watering in ms.
+func (w *SimWuc) ReadLastWatering() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return int(w.lastWatering) * 250, nil
+}
+
+// SetRefillInterval sets simulated refill interval.
+func (w *SimWuc) SetRefillInterval(i uint8) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.refill = i
+	return nil
+}
+
+// ReadRefillInterval returns simulated refill interval.
+func (w *SimWuc) ReadRefillInterval() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return int(w.refill), nil
+}
+
+// Echo returns a copy of given data.
+func (w *SimWuc) Echo(buf []byte) ([]byte, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	b := make([]byte, len(buf))
+	copy(b, buf)
+	return b, nil
+}
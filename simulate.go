@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// runSimulate runs the station against a simulated plant in virtual time
+// and reports how well the weight is kept within LowLevel and HighLevel.
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	days := fs.Int("days", 14, "simulated days")
+	configFile := fs.String("config", "", "plant config")
+	dryout := fs.Int("dryout", defaultSimConfig.Dryout, "weight lost per 24h")
+	dayNight := fs.Float64("daynight", defaultSimConfig.DayNight, "relative day/night variation of dryout")
+	flow := fs.Float64("flow", defaultSimConfig.Flow, "weight gain per ms of watering")
+	noise := fs.Int("noise", defaultSimConfig.Noise, "maximum deviation of weight readings")
+	failures := fs.Float64("failures", 0, "probability of failed weight readings")
+	reservoir := fs.Int("reservoir", 1000000, "initial water in reservoir")
+	seed := fs.Int64("seed", 1, "random seed")
+	scale := fs.Int("scale", 0, "initial watering time per weight gain, 0 derives it from flow")
+	startDate := fs.String("start", "2020-01-01", "start date")
+	tz := fs.String("tz", "Local", "time zone of station")
+	verbose := fs.Bool("v", false, "log station output")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: plantcare simulate [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config := defaultPlantConfig
+	if *configFile != "" {
+		if err := readJSONFile(*configFile, &config); err != nil {
+			log.Fatalf("failed to read %s: %v", *configFile, err)
+		}
+	}
+
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		log.Fatalf("invalid time zone: %v", err)
+	}
+	start, err := time.ParseInLocation("2006-01-02", *startDate, loc)
+	if err != nil {
+		log.Fatalf("invalid start date: %v", err)
+	}
+
+	// station runs in local time
+	time.Local = loc
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s, sim := newSimStation(config, simConfig{
+		Weight:      (config.LowLevel + config.HighLevel) / 2,
+		Dryout:      *dryout,
+		DayNight:    *dayNight,
+		Flow:        *flow,
+		Reservoir:   *reservoir,
+		Noise:       *noise,
+		FailureRate: *failures,
+		Seed:        *seed,
+	}, start)
+
+	// initial model, learned from waterings in the course of simulation
+	s.WateringTimeData.Scale = *scale
+	if *scale == 0 && *flow > 0 {
+		s.WateringTimeData.Scale = int(1 / *flow)
+	}
+
+	fmt.Println("day  min   max   below  above  waterings  water/ms  reservoir")
+	var total simResult
+	for d := 1; d <= *days; d++ {
+		s.runUntil(start.AddDate(0, 0, d))
+		r := s.simResult(24)
+		total.add(r)
+		fmt.Printf("%3d  %4d  %4d  %5d  %5d  %9d  %8d  %9d\n",
+			d, r.min, r.max, r.below, r.above, r.waterings, r.water, sim.Reservoir())
+	}
+
+	fmt.Println()
+	fmt.Printf("hours below low level:  %d\n", total.below)
+	fmt.Printf("hours above high level: %d\n", total.above)
+	fmt.Printf("waterings:              %d (%d ms)\n", total.waterings, total.water)
+	fmt.Printf("final model:            scale %d, offset %d\n",
+		s.WateringTimeData.Scale, s.WateringTimeData.Offset)
+}
+
+// newSimStation creates a station without files, MQTT and camera running
+// against a simulated plant on a fake clock starting at given time.
+func newSimStation(c plantConfig, sc simConfig, start time.Time) (*station, *SimWuc) {
+	clk := newFakeClock(start)
+	sim := NewSimWuc(sc, clk)
+
+	// no camera to take pictures with
+	c.UpdateHour = -1
+
+	s := &station{
+		Config:  c,
+		clock:   clk,
+		metrics: newMetrics(),
+		Data: measurementData{
+			Time: start.Hour(),
+		},
+	}
+	s.wuc = &busyController{&instrumentedController{sim, s.metrics}, s}
+	s.scheduler = s.newScheduler()
+
+	return s, sim
+}
+
+// simResult summarizes the hourly samples of a simulation.
+type simResult struct {
+	min, max     int
+	below, above int
+	waterings    int
+	water        int
+}
+
+func (r *simResult) add(o simResult) {
+	r.below += o.below
+	r.above += o.above
+	r.waterings += o.waterings
+	r.water += o.water
+}
+
+// simResult summarizes the last given number of hours.
+func (s *station) simResult(hours int) simResult {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var r simResult
+	i0 := len(s.Data.Weight) - hours
+	if i0 < 0 {
+		i0 = 0
+	}
+	for i := i0; i < len(s.Data.Weight); i++ {
+		w := s.Data.Weight[i]
+		if i == i0 || w < r.min {
+			r.min = w
+		}
+		if i == i0 || w > r.max {
+			r.max = w
+		}
+		if w < s.Config.LowLevel {
+			r.below++
+		} else if w > s.Config.HighLevel {
+			r.above++
+		}
+		if wt := s.Data.Watering[i]; wt > 0 {
+			r.waterings++
+			r.water += wt
+		}
+	}
+	return r
+}
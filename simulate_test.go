@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSimulateScenarios(t *testing.T) {
+	setLocal(t, time.UTC)
+
+	const (
+		days = 14
+		// days the model needs to learn dryout and watering time
+		warmup = 3
+	)
+
+	tests := []struct {
+		dryout   int
+		failures float64
+		windows  []wateringWindow
+	}{
+		{30, 0, nil},
+		{30, 0.3, nil},
+		{60, 0, nil},
+		{60, 0.1, nil},
+		{60, 0.3, nil},
+		{120, 0, []wateringWindow{{Hour: 8, Share: 1}, {Hour: 20, Share: 1}}},
+		{120, 0.1, []wateringWindow{{Hour: 8, Share: 1}, {Hour: 20, Share: 1}}},
+		{120, 0.3, []wateringWindow{{Hour: 8, Share: 1}, {Hour: 20, Share: 1}}},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("dryout %v failures %v windows %v", tt.dryout, tt.failures, len(tt.windows))
+		t.Run(name, func(t *testing.T) {
+			c := defaultPlantConfig
+			c.Windows = tt.windows
+			sc := defaultSimConfig
+			sc.Weight = (c.LowLevel + c.HighLevel) / 2
+			sc.Dryout = tt.dryout
+			sc.Reservoir = 1000000
+			sc.FailureRate = tt.failures
+			sc.Seed = 1
+			start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			s, _ := newSimStation(c, sc, start)
+			s.WateringTimeData.Scale = int(1 / sc.Flow)
+
+			s.runUntil(start.AddDate(0, 0, days))
+			// skip the days of learning
+			r := s.simResult((days - warmup) * 24)
+
+			// weight may fall by up to an hour of dryout at peak and noise
+			// below LowLevel before it is refilled
+			tol := sc.Noise + int(float64(sc.Dryout)*(1+sc.DayNight))/24
+			if r.min < c.LowLevel-tol {
+				t.Errorf("weight fell to %v, below low level %v", r.min, c.LowLevel)
+			}
+			if r.max > c.HighLevel+sc.Noise {
+				t.Errorf("weight rose to %v, above high level %v", r.max, c.HighLevel)
+			}
+			if r.waterings < days-warmup {
+				t.Errorf("watered %v times in %v days", r.waterings, days-warmup)
+			}
+		})
+	}
+}
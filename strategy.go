@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// wateringInput is the recent history a watering strategy decides on.
+type wateringInput struct {
+	Hour int
+	// Weight is the current weight.
+	Weight int
+	// Weights and Waterings are the hourly samples, oldest first, not
+	// including the current hour.
+	Weights   []int
+	Waterings []int
+	// Times are the unix times of the hourly samples.
+	Times []int64
+	// Day is the start of the local day of the current hour.
+	Day    time.Time
+	Config plantConfig
+}
+
+// wateringModel is the learned relation of weight and watering time.
+type wateringModel struct {
+	// Dryout is the weight lost per 24h.
+	Dryout int
+	// Scale and Offset give the watering time for a weight gain.
+	Scale  int
+	Offset int
+}
+
+// time returns watering time in ms for given weight gain.
+func (m wateringModel) time(dw int) int {
+	return m.Scale*dw + m.Offset
+}
+
+// wateringPlan is the result of a watering strategy.
+type wateringPlan struct {
+	// Delta is the planned weight gain, 0 if unknown.
+	Delta int
+	// Time is the watering time in ms.
+	Time int
+}
+
+// A wateringStrategy decides when and how much to water.
+type wateringStrategy interface {
+	// due reports whether watering is evaluated for given input, the
+	// model is only fitted for due evaluations.
+	due(in *wateringInput) bool
+	// plan returns the watering for given input and model.
+	plan(in *wateringInput, m wateringModel) wateringPlan
+}
+
+// lastWatering returns the last watering time and the number of hours
+// since then.
+func (in *wateringInput) lastWatering() (lastw, durw int) {
+	return in.lastWateringBefore(0)
+}
+
+// lastWateringBefore returns the last watering time ignoring waterings of
+// the last skip hours and the number of hours since then.
+func (in *wateringInput) lastWateringBefore(skip int) (lastw, durw int) {
+	durw = 1
+	for i := len(in.Waterings) - 1 - skip; i >= 0; i-- {
+		durw = len(in.Waterings) - i
+		if in.Waterings[i] > 0 {
+			lastw = in.Waterings[i]
+			break
+		}
+	}
+	return
+}
+
+// wateringWindow is an hour of the day watering is evaluated at.
+type wateringWindow struct {
+	Hour int `json:"hour"`
+	// Share is the share of the daily watering relative to the shares of
+	// the other windows.
+	Share int `json:"share"`
+	// Refill is the weight gain of this window instead of a share of the
+	// daily watering, 0 uses Share.
+	Refill int `json:"refill,omitempty"`
+}
+
+// windows returns the watering windows, a single window at WaterHour if
+// none are configured.
+func (c *plantConfig) windows() []wateringWindow {
+	if len(c.Windows) == 0 {
+		return []wateringWindow{{Hour: c.WaterHour, Share: 1}}
+	}
+	return c.Windows
+}
+
+// window returns the watering window of current hour and the sum of the
+// shares of this and the later windows of the day.
+func (in *wateringInput) window() (w wateringWindow, remaining int, ok bool) {
+	for _, cw := range in.Config.windows() {
+		if cw.Hour == in.Hour {
+			w = cw
+			ok = true
+		}
+		if cw.Hour >= in.Hour && cw.Refill == 0 {
+			remaining += cw.Share
+		}
+	}
+	return
+}
+
+// today returns the number of hourly samples of today before current hour.
+func (in *wateringInput) today() int {
+	if len(in.Times) != len(in.Waterings) {
+		// no timestamps, assume a sample for every hour of today
+		if in.Hour > len(in.Waterings) {
+			return len(in.Waterings)
+		}
+		return in.Hour
+	}
+	n := 0
+	for i := len(in.Times) - 1; i >= 0 && in.Times[i] >= in.Day.Unix(); i-- {
+		n++
+	}
+	return n
+}
+
+// wateredToday returns the sum of watering times of today.
+func (in *wateringInput) wateredToday() int {
+	sum := 0
+	for _, w := range in.Waterings[len(in.Waterings)-in.today():] {
+		sum += w
+	}
+	return sum
+}
+
+// wateringsToday returns the number of waterings of today.
+func (in *wateringInput) wateringsToday() int {
+	n := 0
+	for _, w := range in.Waterings[len(in.Waterings)-in.today():] {
+		if w > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func newWateringStrategy(name string) (wateringStrategy, error) {
+	switch name {
+	case "", "adaptive":
+		return adaptiveStrategy{}, nil
+	case "schedule":
+		return scheduleStrategy{}, nil
+	case "band":
+		return bandStrategy{}, nil
+	case "soakdry":
+		return soakDryStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown watering strategy: %s", name)
+}
+
+// adaptiveStrategy waters in the watering windows of the day. It refills to
+// HighLevel when weight falls to LowLevel, refills to cover the expected
+// dryout until the next day, or refills by DailyRefill otherwise. The daily
+// refill is split among the windows by their shares.
+type adaptiveStrategy struct{}
+
+func (adaptiveStrategy) due(in *wateringInput) bool {
+	_, _, ok := in.window()
+	return ok
+}
+
+func (adaptiveStrategy) plan(in *wateringInput, m wateringModel) wateringPlan {
+	c := &in.Config
+	weight := in.Weight
+
+	win, remaining, _ := in.window()
+	if win.Refill > 0 {
+		dw := win.Refill
+		if dw > c.HighLevel-weight {
+			dw = c.HighLevel - weight
+		}
+		log.Printf("window refill by %v", dw)
+		return wateringPlan{Delta: dw, Time: m.time(dw)}
+	}
+
+	// the daily refill is calculated from the last watering before today,
+	// the weight already includes the waterings of today
+	skip := 0
+	if wt := in.wateredToday(); wt > 0 {
+		log.Printf("watered %v ms today", wt)
+		skip = in.today()
+	}
+	lastw, durw := in.lastWateringBefore(skip)
+
+	prevhi := weight
+	prevlo := weight
+	if durw > 1 && len(in.Weights) >= durw {
+		prevlo = in.Weights[len(in.Weights)-durw]
+		prevhi = in.Weights[len(in.Weights)-durw+1]
+	}
+
+	log.Printf("last watered %v hours ago, watered %vs, last weights: %v, %v",
+		durw, lastw, prevlo, prevhi)
+
+	dw := 0
+	wt := 0
+	minLevel := c.LowLevel + m.Dryout*23/24
+
+	if weight <= c.LowLevel {
+		// full refill
+		dw = c.HighLevel - weight
+		wt = m.time(dw)
+		log.Printf("full refill")
+	} else if weight < minLevel {
+		dwhi := c.HighLevel - weight
+		dwlo := minLevel - weight
+		hiwt := m.time(dwhi)
+		lowt := m.time(dwlo)
+		// clamp to high level
+		if minLevel > c.HighLevel {
+			log.Print("clamping refill to high level")
+			dw = dwhi
+			wt = hiwt
+		} else if prevlo < minLevel && prevhi < (c.HighLevel+minLevel)/2 {
+			// Previous low level was already in range for minimum refill,
+			// and previous high level was nearer to minimum refill level
+			// than to full refill.
+			log.Print("refill to high level")
+			dw = dwhi
+			wt = hiwt
+		} else {
+			log.Print("minimum refill")
+			dw = dwlo
+			wt = lowt
+		}
+	} else if c.DailyRefill > 0 {
+		dw = prevhi - m.Dryout*durw/24 + c.DailyRefill - weight
+		// clamp to previous weight
+		if dw > prevhi-weight {
+			dw = prevhi - weight
+		}
+		wt = m.time(dw)
+		log.Print("daily refill")
+	}
+
+	if weight > c.LowLevel && remaining > win.Share && dw > 0 {
+		// leave remaining refill to later windows of the day
+		dw = dw * win.Share / remaining
+		wt = m.time(dw)
+		log.Printf("window share %v/%v", win.Share, remaining)
+	}
+
+	return wateringPlan{Delta: dw, Time: wt}
+}
+
+// scheduleStrategy waters a fixed time every ScheduleDays, split among the
+// watering windows of the day.
+type scheduleStrategy struct{}
+
+func (scheduleStrategy) due(in *wateringInput) bool {
+	if _, _, ok := in.window(); !ok {
+		return false
+	}
+	if in.wateredToday() > 0 {
+		// scheduled day, continue in later windows
+		return true
+	}
+	days := in.Config.ScheduleDays
+	if days < 1 {
+		days = 1
+	}
+	lastw, durw := in.lastWatering()
+	// allow an hour of jitter of the update timer
+	return lastw == 0 || durw >= days*24-1
+}
+
+func (scheduleStrategy) plan(in *wateringInput, m wateringModel) wateringPlan {
+	log.Printf("scheduled watering every %v days", in.Config.ScheduleDays)
+	win, remaining, _ := in.window()
+	if win.Refill > 0 {
+		return wateringPlan{Delta: win.Refill, Time: m.time(win.Refill)}
+	}
+	// recorded watering times do not include the offset of each watering
+	wt := in.Config.ScheduleTime - in.wateredToday() - in.wateringsToday()*m.Offset
+	if remaining > win.Share {
+		wt = wt * win.Share / remaining
+	}
+	return wateringPlan{Time: wt}
+}
+
+// bandStrategy refills to HighLevel at any hour as soon as weight falls
+// below LowLevel.
+type bandStrategy struct{}
+
+func (bandStrategy) due(in *wateringInput) bool {
+	if in.Weight >= in.Config.LowLevel {
+		return false
+	}
+	// give water time to reach the sensor before watering again
+	lastw, durw := in.lastWatering()
+	return lastw == 0 || durw > 2
+}
+
+func (bandStrategy) plan(in *wateringInput, m wateringModel) wateringPlan {
+	dw := in.Config.HighLevel - in.Weight
+	log.Printf("band refill by %v", dw)
+	return wateringPlan{Delta: dw, Time: m.time(dw)}
+}
+
+// soakDryStrategy lets the pot dry out to LowLevel and then soaks it in two
+// passes, at WaterHour and an hour later, up to HighLevel.
+type soakDryStrategy struct{}
+
+func (soakDryStrategy) soaking(in *wateringInput) bool {
+	n := len(in.Waterings)
+	return in.Hour == (in.Config.WaterHour+1)%24 && n > 0 && in.Waterings[n-1] > 0
+}
+
+func (s soakDryStrategy) due(in *wateringInput) bool {
+	if s.soaking(in) {
+		return in.Weight < in.Config.HighLevel
+	}
+	return in.Hour == in.Config.WaterHour && in.Weight <= in.Config.LowLevel
+}
+
+func (s soakDryStrategy) plan(in *wateringInput, m wateringModel) wateringPlan {
+	dw := in.Config.HighLevel - in.Weight
+	if s.soaking(in) {
+		log.Printf("second soak pass by %v", dw)
+	} else {
+		dw /= 2
+		log.Printf("first soak pass by %v", dw)
+	}
+	return wateringPlan{Delta: dw, Time: m.time(dw)}
+}
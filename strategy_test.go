@@ -0,0 +1,287 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// strategyInput returns the input of the watering strategy at hour with
+// constant weight and given hourly waterings, oldest first.
+func strategyInput(hour, weight int, waterings ...int) *wateringInput {
+	in := &wateringInput{
+		Hour:      hour,
+		Weight:    weight,
+		Weights:   make([]int, len(waterings)),
+		Waterings: waterings,
+		Config: plantConfig{
+			WaterHour: 20,
+			LowLevel:  1400,
+			HighLevel: 1500,
+		},
+	}
+	for i := range in.Weights {
+		in.Weights[i] = weight
+	}
+	return in
+}
+
+var strategyModel = wateringModel{Dryout: 100, Scale: 10, Offset: 500}
+
+func TestBandStrategy(t *testing.T) {
+	tests := []struct {
+		name string
+		in   *wateringInput
+		due  bool
+		want wateringPlan
+	}{
+		{
+			name: "at low level",
+			in:   strategyInput(3, 1400, 0, 0, 0),
+		},
+		{
+			name: "below low level",
+			in:   strategyInput(3, 1399, 0, 0, 0),
+			due:  true,
+			want: wateringPlan{Delta: 101, Time: 1510},
+		},
+		{
+			name: "watered two hours ago",
+			in:   strategyInput(3, 1350, 0, 1000, 0),
+		},
+		{
+			name: "watered three hours ago",
+			in:   strategyInput(3, 1350, 1000, 0, 0),
+			due:  true,
+			want: wateringPlan{Delta: 150, Time: 2000},
+		},
+		{
+			name: "no history",
+			in:   strategyInput(20, 1300),
+			due:  true,
+			want: wateringPlan{Delta: 200, Time: 2500},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := bandStrategy{}
+			if due := st.due(tt.in); due != tt.due {
+				t.Fatalf("due = %v, want %v", due, tt.due)
+			}
+			if !tt.due {
+				return
+			}
+			if p := st.plan(tt.in, strategyModel); p != tt.want {
+				t.Errorf("plan = %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestSoakDryStrategy(t *testing.T) {
+	tests := []struct {
+		name string
+		in   *wateringInput
+		due  bool
+		want wateringPlan
+	}{
+		{
+			name: "water hour above low level",
+			in:   strategyInput(20, 1401, 0, 0),
+		},
+		{
+			name: "water hour at low level",
+			in:   strategyInput(20, 1400, 0, 0),
+			due:  true,
+			want: wateringPlan{Delta: 50, Time: 1000},
+		},
+		{
+			name: "other hour below low level",
+			in:   strategyInput(10, 1300, 0, 0),
+		},
+		{
+			name: "second pass after first",
+			in:   strategyInput(21, 1450, 0, 1000),
+			due:  true,
+			want: wateringPlan{Delta: 50, Time: 1000},
+		},
+		{
+			name: "second pass without first",
+			in:   strategyInput(21, 1300, 0, 0),
+		},
+		{
+			name: "second pass at high level",
+			in:   strategyInput(21, 1500, 0, 1000),
+		},
+		{
+			name: "no second pass two hours later",
+			in:   strategyInput(22, 1450, 1000, 0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := soakDryStrategy{}
+			if due := st.due(tt.in); due != tt.due {
+				t.Fatalf("due = %v, want %v", due, tt.due)
+			}
+			if !tt.due {
+				return
+			}
+			if p := st.plan(tt.in, strategyModel); p != tt.want {
+				t.Errorf("plan = %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+// hourlyInput returns the input of the watering strategy at hour t with
+// hourly samples at given times, watered at the samples of given indices.
+func hourlyInput(t time.Time, times []time.Time, watered ...int) *wateringInput {
+	y, m, d := t.Date()
+	in := &wateringInput{
+		Hour:      t.Hour(),
+		Weight:    1450,
+		Weights:   make([]int, len(times)),
+		Waterings: make([]int, len(times)),
+		Times:     make([]int64, len(times)),
+		Day:       time.Date(y, m, d, 0, 0, 0, 0, t.Location()),
+		Config:    defaultPlantConfig,
+	}
+	for i, ts := range times {
+		in.Weights[i] = 1450
+		in.Times[i] = ts.Unix()
+	}
+	for _, i := range watered {
+		in.Waterings[i] = 1000
+	}
+	return in
+}
+
+// hoursBefore returns n hourly times ending an hour before t.
+func hoursBefore(t time.Time, n int) []time.Time {
+	times := make([]time.Time, n)
+	for i := range times {
+		times[i] = t.Add(-time.Duration(n-i) * time.Hour)
+	}
+	return times
+}
+
+func TestToday(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	noon := time.Date(2020, 6, 2, 12, 0, 0, 0, berlin)
+
+	tests := []struct {
+		name    string
+		in      *wateringInput
+		today   int
+		watered int
+	}{
+		{
+			name:  "regular day",
+			in:    hourlyInput(noon, hoursBefore(noon, 48)),
+			today: 12,
+		},
+		{
+			name: "station down since yesterday evening",
+			// watered yesterday at 20:00, down from 22:00 to 10:00
+			in: hourlyInput(noon, append(
+				hoursBefore(noon.Add(-14*time.Hour), 24),
+				hoursBefore(noon, 2)...), 22),
+			today: 2,
+		},
+		{
+			name:    "watered this morning",
+			in:      hourlyInput(noon, hoursBefore(noon, 24), 20),
+			today:   12,
+			watered: 1000,
+		},
+		{
+			name: "spring forward",
+			// 02:00 skipped
+			in: hourlyInput(time.Date(2020, 3, 29, 12, 0, 0, 0, berlin),
+				hoursBefore(time.Date(2020, 3, 29, 12, 0, 0, 0, berlin), 24)),
+			today: 11,
+		},
+		{
+			name: "fall back",
+			// 02:00 repeated
+			in: hourlyInput(time.Date(2020, 10, 25, 12, 0, 0, 0, berlin),
+				hoursBefore(time.Date(2020, 10, 25, 12, 0, 0, 0, berlin), 24)),
+			today: 13,
+		},
+		{
+			name: "no timestamps",
+			in: func() *wateringInput {
+				in := hourlyInput(noon, hoursBefore(noon, 24), 23)
+				in.Times = nil
+				return in
+			}(),
+			today:   12,
+			watered: 1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := tt.in.today(); n != tt.today {
+				t.Errorf("today() = %v, want %v", n, tt.today)
+			}
+			if wt := tt.in.wateredToday(); wt != tt.watered {
+				t.Errorf("wateredToday() = %v, want %v", wt, tt.watered)
+			}
+		})
+	}
+}
+
+func TestScheduleDueAfterDowntime(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	noon := time.Date(2020, 6, 2, 12, 0, 0, 0, berlin)
+
+	// watered yesterday at 20:00, down from 22:00 to 10:00
+	times := append(hoursBefore(noon.Add(-14*time.Hour), 24), hoursBefore(noon, 2)...)
+	in := hourlyInput(noon, times, 22)
+	in.Config.ScheduleDays = 1
+	in.Config.ScheduleTime = 2000
+	in.Config.Windows = []wateringWindow{{Hour: 12, Share: 1}, {Hour: 20, Share: 1}}
+
+	if (scheduleStrategy{}).due(in) {
+		t.Error("watering of yesterday continued today")
+	}
+}
+
+func TestSchedulePlan(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	morning := time.Date(2020, 6, 2, 8, 0, 0, 0, berlin)
+	evening := time.Date(2020, 6, 2, 20, 0, 0, 0, berlin)
+
+	tests := []struct {
+		name string
+		in   *wateringInput
+		want int
+	}{
+		{
+			name: "first window",
+			in:   hourlyInput(morning, hoursBefore(morning, 24)),
+			want: 1000,
+		},
+		{
+			// 1000 ms and offset of 500 ms watered in the morning
+			name: "last window",
+			in:   hourlyInput(evening, hoursBefore(evening, 24), 12),
+			want: 500,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.in.Config.ScheduleDays = 1
+			tt.in.Config.ScheduleTime = 2000
+			tt.in.Config.Windows = []wateringWindow{{Hour: 8, Share: 1}, {Hour: 20, Share: 1}}
+
+			if p := (scheduleStrategy{}).plan(tt.in, strategyModel); p.Time != tt.want {
+				t.Errorf("planned %v ms, want %v", p.Time, tt.want)
+			}
+		})
+	}
+}
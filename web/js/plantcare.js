@@ -76,6 +76,24 @@ window.onload = function () {
                     borderColor: "#0030a0",
                     backgroundColor: "#1060c0",
                     fill: false
+                },
+                {
+                    type: 'bar',
+                    data: [],
+                    yAxisID: 'water-y-axis',
+                    label: "Shadow Watering",
+                    borderColor: "#8090b0",
+                    backgroundColor: "#c0d0e8",
+                    fill: false
+                },
+                {
+                    type: 'bar',
+                    data: [],
+                    yAxisID: 'water-y-axis',
+                    label: "Suppressed Watering",
+                    borderColor: "#b03020",
+                    backgroundColor: "#e8a090",
+                    fill: false
                 }
             ]
         },
@@ -154,6 +172,14 @@ window.onload = function () {
         }
     });
 
+    // colors of measured, fallback, interpolated, calibrating, rejected and
+    // busy samples
+    var qualityColors = ["#408040", "#c04040", "#a0a0a0", "#a040c0", "#e0a000", "#4060c0"];
+
+    function qualityColor(q) {
+        return qualityColors[q] || qualityColors[0];
+    }
+
     function getData() {
         var xhttp = new XMLHttpRequest();
         xhttp.onreadystatechange = function () {
@@ -161,18 +187,21 @@ window.onload = function () {
                 var resp = JSON.parse(xhttp.responseText);
                 var data = resp.data;
                 var len = data.weight.length;
-                var start = (data.time + 1 - (len % 24) + 24) % 24;
                 var iw = 0;
                 var h;
                 var avg = 0;
                 var count = 0;
                 var i, j, w;
+                chart.data.datasets[0].pointBackgroundColor = [];
                 for (i = 0; i < len; ++i) {
                     w = data.water[i];
-                    h = (start + i) % 24;
+                    h = new Date(data.times[i] * 1000).getHours();
                     chart.data.labels.push(h);
                     chart.data.datasets[0].data.push(data.weight[i]);
+                    chart.data.datasets[0].pointBackgroundColor.push(qualityColor(data.quality[i]));
                     chart.data.datasets[2].data.push(w / 1000);
+                    chart.data.datasets[3].data.push(data.shadow ? data.shadow[i] / 1000 : 0);
+                    chart.data.datasets[4].data.push(data.suppressed ? data.suppressed[i] / 1000 : 0);
                     avg += data.weight[i];
                     ++count;
                     if (w > 0) {
@@ -195,6 +224,13 @@ window.onload = function () {
 
 
                 var config = resp.config;
+
+                // weights are in grams once calibrated, raw counts otherwise
+                if (resp.calibration && resp.calibration.scale) {
+                    chart.data.datasets[0].label = "Plant Weight (g)";
+                    chart.data.datasets[1].label = "Average Weight (g)";
+                    minchart.data.datasets[0].label = "Plant Weight (g)";
+                }
                 chart.options.scales.yAxes[0].ticks.min = 0;
                 chart.options.scales.yAxes[0].ticks.max = Math.ceil(config.max / 1000);
                 chart.options.scales.yAxes[1].ticks.suggestedMin = Math.floor((config.low) / 10) * 10;
@@ -207,13 +243,13 @@ window.onload = function () {
 
                 var mindata = resp.mindata;
                 var mlen = mindata.weight ? mindata.weight.length : 0;
-                var minstart = (mindata.time + 1 - (mlen % 60) + 60) % 60;
                 var min;
+                minchart.data.datasets[0].pointBackgroundColor = [];
                 for (i = 0; i < mlen; ++i) {
-                    min = (minstart + i) % 60;
+                    min = new Date(mindata.times[i] * 1000).getMinutes();
                     minchart.data.labels.push(min);
+                    minchart.data.datasets[0].pointBackgroundColor.push(qualityColor(mindata.quality[i]));
                     // minchart.data.datasets[0].data.push(mindata.moisture[i]);
-                    // 4052 is weight value with no load
                     minchart.data.datasets[0].data.push(mindata.weight[i]);
                 }
 
@@ -221,10 +257,45 @@ window.onload = function () {
                 minchart.options.scales.yAxes[0].ticks.suggestedMax = Math.ceil((config.high) / 10) * 10;
 
                 minchart.update();
+
+                var res = resp.reservoir;
+                var el = document.getElementById("reservoir");
+                if (res && res.level >= 0) {
+                    el.textContent = "Reservoir: " + res.level +
+                        (res.days >= 0 ? ", " + res.days.toFixed(1) + " days left" : "") +
+                        (res.alarm ? " (" + res.alarm + ")" : "");
+                    el.style.color = res.alarm ? "#ff0000" : "";
+                }
+
+                var sensor = resp.sensor;
+                el = document.getElementById("sensor");
+                el.textContent = sensor && sensor.state ?
+                    "Weight sensor " + sensor.state + ", automatic watering disabled" : "";
             }
         };
         xhttp.open("GET", "/data", true);
         xhttp.send();
     }
+    function getAlerts() {
+        var xhttp = new XMLHttpRequest();
+        xhttp.onreadystatechange = function () {
+            if (this.readyState == 4 && this.status == 200) {
+                var alerts = JSON.parse(xhttp.responseText) || [];
+                var list = document.getElementById("alerts");
+                list.innerHTML = "";
+                for (var i = alerts.length - 1; i >= 0; --i) {
+                    var item = document.createElement("li");
+                    item.textContent = new Date(alerts[i].time * 1000).toLocaleString() +
+                        " " + alerts[i].type + ": " + alerts[i].message +
+                        (alerts[i].repeated ? " (" + alerts[i].repeated + " more)" : "");
+                    list.appendChild(item);
+                }
+            }
+        };
+        xhttp.open("GET", "/alerts", true);
+        xhttp.send();
+    }
+
     getData();
+    getAlerts();
 };
@@ -29,6 +29,7 @@ const CPR = 15808
 type Wuc struct {
 	connection i2c.Connection
 	mutex      *sync.Mutex
+	sleep      func(time.Duration)
 }
 
 // NewWuc creates an instance of a Wuc.
@@ -38,10 +39,15 @@ func NewWuc(c i2c.Connector) (*Wuc, error) {
 		return nil, err
 	}
 
+	return newWuc(connection, time.Sleep), nil
+}
+
+func newWuc(c i2c.Connection, sleep func(time.Duration)) *Wuc {
 	return &Wuc{
-		connection: connection,
+		connection: c,
 		mutex:      &sync.Mutex{},
-	}, nil
+		sleep:      sleep,
+	}
 }
 
 // ReadWeight triggers read of weight sensor.
@@ -53,7 +59,7 @@ func (w *Wuc) ReadWeight() (m int, err error) {
 		return
 	}
 
-	time.Sleep(700 * time.Millisecond)
+	w.sleep(700 * time.Millisecond)
 
 	var buf [2]byte
 	n, err := w.connection.Read(buf[:])
@@ -77,7 +83,7 @@ func (w *Wuc) ReadWeight() (m int, err error) {
 func (w *Wuc) waitForStop(timeout int) error {
 	for i := 0; i < timeout; i++ {
 		// wait a second before checking status
-		time.Sleep(time.Second)
+		w.sleep(time.Second)
 
 		var buf [2]byte
 		n, err := w.connection.Read(buf[:])
@@ -170,7 +176,7 @@ func (w *Wuc) DoWatering(start, watering int) int {
 	// wait for:
 	//  - for watering to finish
 	//  - and some margin
-	time.Sleep(time.Duration(start+watering+500) * time.Millisecond)
+	w.sleep(time.Duration(start+watering+500) * time.Millisecond)
 
 	// might return 0 when rotation takes longer than desired
 	r, err := w.connection.ReadByte()
@@ -193,7 +199,7 @@ func (w *Wuc) DoWatering(start, watering int) int {
 		}
 
 		for i := 0; r == 0 && i < 5; i++ {
-			time.Sleep(time.Millisecond * 100)
+			w.sleep(time.Millisecond * 100)
 			r, err = w.readLastWatering()
 			if err != nil {
 				log.Println(err)
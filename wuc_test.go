@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newFakeWuc() (*Wuc, *FakeWucConnection) {
+	f := NewFakeWucConnection()
+	return newWuc(f, f.Sleep), f
+}
+
+func lastCommand(f *FakeWucConnection) byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.Commands) == 0 {
+		return 0
+	}
+	return f.Commands[len(f.Commands)-1]
+}
+
+func TestReadWeight(t *testing.T) {
+	w, f := newFakeWuc()
+	f.Weight = 0x1234
+
+	m, err := w.ReadWeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != 0x1234 {
+		t.Errorf("got weight %v, want %v", m, 0x1234)
+	}
+
+	f.WeightFail = true
+	if _, err := w.ReadWeight(); err == nil {
+		t.Error("no error on failed measurement")
+	}
+
+	// reply before measurement finished
+	f.WeightFail = false
+	f.MeasureTime = time.Second
+	if _, err := w.ReadWeight(); err == nil {
+		t.Error("no error on unfinished measurement")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	w, f := newFakeWuc()
+
+	start := f.Now()
+	if err := w.Rotate(180); err != nil {
+		t.Fatal(err)
+	}
+	if d := f.Now().Sub(start); d < f.RotationTime/2 {
+		t.Errorf("returned after %v, before rotation finished", d)
+	}
+	if c := lastCommand(f); c == cmdStop {
+		t.Error("motor stopped after finished rotation")
+	}
+}
+
+func TestRotatePartialWrite(t *testing.T) {
+	w, f := newFakeWuc()
+	f.MaxWrite = 2
+
+	if err := w.Rotate(90); err == nil {
+		t.Error("no error on incomplete command")
+	}
+}
+
+func TestWaitForStopTimeout(t *testing.T) {
+	w, f := newFakeWuc()
+	f.Stuck = true
+
+	start := f.Now()
+	if err := w.Rotate(90); err == nil {
+		t.Fatal("no error on stuck motor")
+	}
+	if d := f.Now().Sub(start); d != 20*time.Second {
+		t.Errorf("timed out after %v, want 20s", d)
+	}
+	if c := lastCommand(f); c != cmdStop {
+		t.Errorf("last command 0x%02x, want stop", c)
+	}
+	if f.motorRunning() {
+		t.Error("motor still running")
+	}
+}
+
+func TestDoWatering(t *testing.T) {
+	w, _ := newFakeWuc()
+
+	if r := w.DoWatering(500, 2000); r != 2000 {
+		t.Errorf("watered %v ms, want 2000", r)
+	}
+	if r, err := w.ReadLastWatering(); err != nil || r != 2000 {
+		t.Errorf("last watering %v ms, %v, want 2000", r, err)
+	}
+}
+
+func TestDoWateringMotorRunning(t *testing.T) {
+	w, f := newFakeWuc()
+	f.Stuck = true
+	// start motor, watering waits for rotation to finish
+	if _, err := f.Write([]byte{cmdRotate, 0x00, 0x10}); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := w.DoWatering(0, 2000); r != 0 {
+		t.Errorf("watered %v ms while motor running, want 0", r)
+	}
+	if c := lastCommand(f); c != cmdGetLastWatering {
+		t.Errorf("last command 0x%02x, want get last watering", c)
+	}
+	stopped := false
+	for _, c := range f.Commands {
+		stopped = stopped || c == cmdStop
+	}
+	if !stopped {
+		t.Error("stuck motor not stopped")
+	}
+}
+
+func TestDoWateringErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(f *FakeWucConnection)
+		start int
+		water int
+	}{
+		{"start out of range", nil, 64000, 1000},
+		{"watering out of range", nil, 0, -1000},
+		{"write error", func(f *FakeWucConnection) {
+			f.WriteErr = map[byte]error{cmdWatering: errors.New("nack")}
+		}, 0, 1000},
+		{"partial write", func(f *FakeWucConnection) {
+			f.MaxWrite = 1
+		}, 0, 1000},
+		{"read error", func(f *FakeWucConnection) {
+			f.ReadErr = map[byte]error{cmdWatering: errors.New("nack")}
+		}, 0, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, f := newFakeWuc()
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			if r := w.DoWatering(tt.start, tt.water); r != 0 {
+				t.Errorf("watered %v ms, want 0", r)
+			}
+		})
+	}
+}
+
+func TestReadWateringLimit(t *testing.T) {
+	w, f := newFakeWuc()
+
+	if l, err := w.ReadWateringLimit(); err != nil || l != f.Limit {
+		t.Errorf("got limit %v, %v, want %v", l, err, f.Limit)
+	}
+
+	f.LimitFail = true
+	if _, err := w.ReadWateringLimit(); err == nil {
+		t.Error("no error on failed measurement")
+	}
+}
+
+func TestRefillInterval(t *testing.T) {
+	w, _ := newFakeWuc()
+
+	if err := w.SetRefillInterval(42); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := w.ReadRefillInterval(); err != nil || r != 42 {
+		t.Errorf("got refill interval %v, %v, want 42", r, err)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	w, _ := newFakeWuc()
+
+	b, err := w.Echo([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string([]byte{1, 2, 3}) {
+		t.Errorf("got echo %v, want [1 2 3]", b)
+	}
+}